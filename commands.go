@@ -0,0 +1,920 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/library"
+	"github.com/IceWizard98/series_downloader/models/queue"
+	"github.com/IceWizard98/series_downloader/models/user"
+	"github.com/IceWizard98/series_downloader/server"
+	progressbar "github.com/IceWizard98/series_downloader/utils/progressBar"
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+)
+
+const DEFAULT_SERVE_ADDRESS = ":8080"
+
+/*
+	Flags shared by every command
+*/
+type commonFlags struct {
+	userName *string
+	provider *string
+	json     *bool
+}
+
+func addCommonFlags(fs *flag.FlagSet) commonFlags {
+	return commonFlags{
+		userName: fs.String("user", "", "User.env file for configuration loading"),
+		provider: fs.String("provider", "", fmt.Sprintf("Series provider, one of %v (default %s)", models.ProvidersList(), models.DEFAULT_PROVIDER)),
+		json:     fs.Bool("json", false, "Print the result as JSON, implies no prompts"),
+	}
+}
+
+func addQualityFlag(fs *flag.FlagSet) *string {
+	return fs.String("quality", "", "Preferred quality: best, worst or a resolution like 720p, the closest available is used (default PREFERRED_QUALITY)")
+}
+
+/*
+	Validates the --quality flag and sets it as PREFERRED_QUALITY for this run
+*/
+func applyQuality(quality string) error {
+	if quality == "" {
+		return nil
+	}
+
+	if _, err := models.ParseQuality(quality); err != nil {
+		return err
+	}
+
+	return os.Setenv("PREFERRED_QUALITY", quality)
+}
+
+/*
+	Returns DOWNLOAD_NEXT_EPISODES from the environment, 0 when unset or invalid
+*/
+func nextEpisodesSetting() uint {
+	downloadNextNEpisodes := os.Getenv("DOWNLOAD_NEXT_EPISODES")
+
+	for _, char := range downloadNextNEpisodes {
+		if !unicode.IsDigit(char) {
+			fmt.Println("⚠️ Only digit are allowed in DOWNLOAD_NEXT_EPISODES")
+		}
+	}
+
+	nextNEpisodes, err := strconv.ParseUint(downloadNextNEpisodes, 10, 16)
+	if err != nil {
+		fmt.Printf("⚠️ Error parsing %s: %s\n", downloadNextNEpisodes, err)
+	}
+
+	return uint(nextNEpisodes)
+}
+
+/*
+	Loads the user configuration and the provider selected by the flags
+*/
+func (c commonFlags) setup() (models.Provider, error) {
+	if *c.json {
+		enableJSON()
+	}
+
+	if _, err := user.GetInstance(*c.userName); err != nil {
+		return nil, err
+	}
+
+	provider, err := models.GetProvider(*c.provider)
+	if provider == nil {
+		return nil, err
+	}
+
+	if err != nil {
+		fmt.Printf("⚠️ %s\n", err)
+	}
+
+	return provider, nil
+}
+
+/*
+	Returns the series of the history saved for the given provider
+*/
+func historySeries(userName string, provider string) []models.Series {
+	u, err := user.GetInstance(userName)
+	if err != nil {
+		return nil
+	}
+
+	seriesList := []models.Series{}
+	for _, h := range u.GetHistory() {
+		if h.Provider == provider || h.Provider == "" {
+			seriesList = append(seriesList, h.Series())
+		}
+	}
+
+	return seriesList
+}
+
+/*
+	Finds a series by id or slug in the history, otherwise searches query
+	on the provider and picks a result by id, slug or with the filter
+*/
+func resolveSeries(provider models.Provider, history []models.Series, query string, filter seriesFilter) (models.Series, error) {
+	for _, series := range history {
+		if series.ID == query || series.Slug == query {
+			return series, nil
+		}
+	}
+
+	seriesList, err := provider.Search(appContext(), query)
+	if err != nil {
+		return models.Series{}, err
+	}
+
+	for _, series := range seriesList {
+		if series.ID == query || series.Slug == query {
+			return series, nil
+		}
+	}
+
+	filter.History = make(map[string]bool, len(history))
+	for _, series := range history {
+		filter.History[series.ID] = true
+	}
+
+	return selectSeries(seriesList, filter, func(i int, v models.Series) string {
+		return fmt.Sprintf("%d - %s", i+1, v.Slug)
+	})
+}
+
+/*
+	Returns the number of the count-th episode after the given one that isn't watched,
+	the last one to ask the provider to download count new episodes
+*/
+func unwatchedEnd(after uint16, count uint, isWatched func(number uint16) bool) uint {
+	end := uint(after)
+	for count > 0 && end < math.MaxUint16 {
+		end++
+		if !isWatched(uint16(end)) {
+			count--
+		}
+	}
+
+	return end
+}
+
+/*
+	Returns the episodes of series in the library, to go on offline when the provider can't list them
+*/
+func localEpisodes(rootDir string, provider string, series models.Series) []models.Episode {
+	episodes := []models.Episode{}
+	for _, entry := range library.GetInstance(rootDir).Episodes(provider, series.ID) {
+		episodes = append(episodes, models.Episode{ID: entry.EpisodeID, Number: entry.Number})
+	}
+
+	return episodes
+}
+
+/*
+	Opens the download queue saved under rootDir and resumes the jobs left by a
+	previous run, their progress is drawn on bars when not nil.
+	Fails when another process (a serve or another download) owns the queue
+*/
+func openQueue(rootDir string, bars *progressbar.Renderer) (*queue.Queue, error) {
+	q, err := queue.New(rootDir, routinepoll.MaxConcurrentDownloads())
+	if err != nil {
+		return nil, err
+	}
+
+	if bars != nil {
+		q.OnProgress = bars.Update
+		q.OnFinish   = func(job queue.Job) {
+			bars.Done(job.Series.Slug, job.Episode.Number)
+		}
+	}
+
+	if resumed := q.Resume(); resumed > 0 {
+		fmt.Printf("🔄 Resuming %d unfinished downloads\n", resumed)
+	}
+
+	return q, nil
+}
+
+/*
+	Returns the result of the given jobs, sorted by episode
+*/
+func jobResults(q *queue.Queue, ids []uint64, rootDir string) []downloadResult {
+	results := make([]downloadResult, 0, len(ids))
+	for _, id := range ids {
+		job, ok := q.Get(id)
+		if !ok {
+			continue
+		}
+
+		result := downloadResult{Episode: job.Episode.Number, Status: STATUS_FAILED, Path: job.Path, Error: job.Error}
+		if job.State != queue.STATE_DONE && result.Error == "" {
+			result.Error = string(job.State)
+		}
+		if job.State == queue.STATE_DONE {
+			result.Status     = STATUS_DOWNLOADED
+			result.Quality, _ = models.RecordedQuality(rootDir, job.Series, job.Episode)
+		}
+
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Episode < results[j].Episode })
+	return results
+}
+
+/*
+	Downloads the episodes through the download queue and returns the result of every one, sorted by episode
+*/
+func downloadEpisodes(provider models.Provider, series models.Series, episodes []models.Episode, rootDir string) []downloadResult {
+	bars   := progressbar.Start()
+	q, err := openQueue(rootDir, bars)
+	if err != nil {
+		bars.Stop()
+
+		results := make([]downloadResult, 0, len(episodes))
+		for _, episode := range episodes {
+			results = append(results, downloadResult{Episode: episode.Number, Status: STATUS_FAILED, Error: err.Error()})
+		}
+		return results
+	}
+
+	ids := make([]uint64, 0, len(episodes))
+	for _, episode := range episodes {
+		ids = append(ids, q.Enqueue(provider.Name(), series, episode).ID)
+	}
+
+	q.Wait()
+	bars.Stop()
+
+	return jobResults(q, ids, rootDir)
+}
+
+/*
+	Returns a function telling the path of an episode of series already on disk,
+	from the library or at the path of the naming template (or its .ts variant).
+	The library is read once, so it can be called for every episode of a long series
+*/
+func episodesOnDisk(rootDir string, provider string, series models.Series) func(episode models.Episode) (string, bool) {
+	known := map[uint16]string{}
+	for _, entry := range library.GetInstance(rootDir).Episodes(provider, series.ID) {
+		known[entry.Number] = entry.Path
+	}
+
+	return func(episode models.Episode) (string, bool) {
+		if path, ok := known[episode.Number]; ok {
+			if _, err := os.Stat(path); err == nil {
+				return path, true
+			}
+		}
+
+		path := models.EpisodePath(rootDir, series, episode)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+
+		path = models.TSPath(path)
+		if _, err := os.Stat(path); err != nil {
+			return "", false
+		}
+
+		return path, true
+	}
+}
+
+/*
+	Downloads a selection of episodes through the download queue, the ones
+	already on disk are skipped. Returns the result of every one, sorted by episode
+*/
+func downloadSelection(provider models.Provider, series models.Series, episodes []models.Episode, rootDir string) []downloadResult {
+	skipped := []downloadResult{}
+	queued  := make([]models.Episode, 0, len(episodes))
+	onDisk  := episodesOnDisk(rootDir, provider.Name(), series)
+
+	for _, episode := range episodes {
+		if path, ok := onDisk(episode); ok {
+			skipped = append(skipped, downloadResult{Episode: episode.Number, Status: STATUS_SKIPPED, Path: path})
+			continue
+		}
+		queued = append(queued, episode)
+	}
+
+	if len(skipped) > 0 {
+		fmt.Printf("✅ %d of %d episodes already downloaded\n", len(skipped), len(episodes))
+	}
+
+	results := skipped
+	if len(queued) > 0 {
+		fmt.Printf("⬇️ Downloading %d episodes\n", len(queued))
+		results = append(results, downloadEpisodes(provider, series, queued, rootDir)...)
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Episode < results[j].Episode })
+	return results
+}
+
+/*
+	Prints a line for every episode with what happened to it and the totals
+*/
+func printSummary(results []downloadResult) {
+	if len(results) == 0 {
+		fmt.Println("Nothing to download")
+		return
+	}
+
+	counts := map[string]int{}
+
+	fmt.Printf("%7s  %-10s  %s\n", "Episode", "Status", "Details")
+	for _, result := range results {
+		details := result.Path
+		switch result.Status {
+		case STATUS_SKIPPED:
+			details = "already on disk: " + result.Path
+		case STATUS_FAILED:
+			// the errors are nested on several lines, keep one line per episode
+			details = strings.ReplaceAll(result.Error, "\n\t- ", "")
+		}
+
+		counts[result.Status]++
+		fmt.Printf("%7d  %-10s  %s\n", result.Episode, result.Status, details)
+	}
+
+	fmt.Printf("%d downloaded, %d skipped, %d failed\n", counts[STATUS_DOWNLOADED], counts[STATUS_SKIPPED], counts[STATUS_FAILED])
+}
+
+/*
+	Returns an error counting the failed downloads, nil when there are none
+*/
+func failedResults(results []downloadResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Status == STATUS_FAILED {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d episodes failed", failed, len(results))
+	}
+
+	return nil
+}
+
+/*
+	Deletes the files of the episodes of series numbered before the given one
+*/
+func deleteEpisodesBefore(rootDir string, provider string, series models.Series, before uint16) {
+	files, err := models.EpisodeFiles(rootDir, series)
+	if err != nil {
+		fmt.Printf("⚠️ Error reading the episodes to delete of %s: \n\t- %s\n", series.Name, err)
+	}
+
+	// the library also knows the files saved with a previous naming template
+	lib := library.GetInstance(rootDir)
+	if series.ID != "" {
+		for _, entry := range lib.Episodes(provider, series.ID) {
+			if !slices.Contains(files[entry.Number], entry.Path) {
+				files[entry.Number] = append(files[entry.Number], entry.Path)
+			}
+		}
+	}
+
+	deletePrev := routinepoll.GetInstance().AddSubGroup("delete_prev", uint(max(len(files), 1)), 1)
+	deleted    := []string{}
+
+	for number, paths := range files {
+		if number >= before {
+			continue
+		}
+
+		for _, path := range paths {
+			deletePrev.AddTask(func() {
+				fmt.Printf("❌ Deleting file %s\n", path)
+
+				// RemoveAll as the segments of an HLS download are in a directory
+				if err := os.RemoveAll(path); err != nil {
+					fmt.Printf("⚠️ Error deleting file %s: \n\t- %s\n", path, err)
+					return
+				}
+				deleted = append(deleted, path)
+			})
+		}
+	}
+
+	deletePrev.Close()
+
+	if err := models.ForgetQualities(rootDir, series, before); err != nil {
+		fmt.Printf("⚠️ Error updating the qualities of %s: \n\t- %s\n", series.Name, err)
+	}
+
+	if err := lib.Remove(deleted...); err != nil {
+		fmt.Printf("⚠️ Error updating the library: \n\t- %s\n", err)
+	}
+
+	// a bloom filter can't forget a value, rebuild it without the deleted files
+	if len(deleted) > 0 {
+		user.RebuildFilter(rootDir)
+	}
+}
+
+/*
+	search [flags] <title>
+*/
+func runSearch(args []string) error {
+	fs    := newFlagSet("search", "[flags] <title>", "Search a series")
+	flags := addCommonFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	title := strings.Join(fs.Args(), " ")
+	if title == "" {
+		fs.Usage()
+		return errors.New("missing title")
+	}
+
+	provider, err := flags.setup()
+	if err != nil {
+		return err
+	}
+
+	seriesList, err := provider.Search(appContext(), title)
+	if err != nil {
+		return err
+	}
+
+	if *flags.json {
+		printJSON(seriesList)
+		return nil
+	}
+
+	if len(seriesList) == 0 {
+		return errors.New("no results found")
+	}
+
+	for i, v := range seriesList {
+		fmt.Printf("%d - %s (id %s, %d episodes)\n", i+1, v.Slug, v.ID, v.Episodes)
+	}
+
+	return nil
+}
+
+/*
+	episodes [flags] <series>
+*/
+func runEpisodes(args []string) error {
+	fs    := newFlagSet("episodes", "[flags] <series>", "List the episodes of a series, given as id, slug or title")
+	flags := addCommonFlags(fs)
+	pick  := fs.Uint("pick", 0, "Select the Nth series when <series> matches more than one")
+	start := fs.Uint("start", 1, "First episode")
+	end   := fs.Uint("end", math.MaxUint, "Last episode")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("missing series")
+	}
+
+	provider, err := flags.setup()
+	if err != nil {
+		return err
+	}
+
+	filter := seriesFilter{Pick: *pick, Interactive: !*flags.json}
+	series, err := resolveSeries(provider, historySeries(*flags.userName, provider.Name()), fs.Arg(0), filter)
+	if err != nil {
+		return err
+	}
+
+	episodes, err := provider.GetEpisodes(appContext(), series, *start, *end)
+	if err != nil {
+		return err
+	}
+
+	if *flags.json {
+		printJSON(struct {
+			Provider string           `json:"provider"`
+			Series   models.Series    `json:"series"`
+			Episodes []models.Episode `json:"episodes"`
+		}{provider.Name(), series, episodes})
+		return nil
+	}
+
+	fmt.Printf("%s (%d episodes)\n", series.Name, series.Episodes)
+	for _, v := range episodes {
+		fmt.Printf("%d\n", v.Number)
+	}
+
+	return nil
+}
+
+/*
+	download [flags] <series> <range>
+*/
+func runDownload(args []string) error {
+	fs    := newFlagSet("download", "[flags] <series> <range>", "Download episodes of a series given as id, slug or title, e.g. download naruto 3-7,10, all or missing")
+	flags := addCommonFlags(fs)
+	pick    := fs.Uint("pick", 0, "Select the Nth series when <series> matches more than one")
+	quality := addQualityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := applyQuality(*quality); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("missing series or episodes range")
+	}
+
+	selection, err := parseEpisodeSelection(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	provider, err := flags.setup()
+	if err != nil {
+		return err
+	}
+
+	filter := seriesFilter{Pick: *pick, Interactive: !*flags.json}
+	series, err := resolveSeries(provider, historySeries(*flags.userName, provider.Name()), fs.Arg(0), filter)
+	if err != nil {
+		return err
+	}
+
+	start, end     := selection.bounds()
+	available, err := provider.GetEpisodes(appContext(), series, start, end)
+	if err != nil {
+		return err
+	}
+
+	u, _          := user.GetInstance(*flags.userName)
+	onDisk        := episodesOnDisk(u.RootDir, provider.Name(), series)
+	episodes, err := selection.apply(available, false, onDisk)
+	if err != nil {
+		return err
+	}
+
+	results := downloadSelection(provider, series, episodes, u.RootDir)
+
+	if *flags.json {
+		printJSON(jsonOutput{Provider: provider.Name(), Series: series, Episodes: results})
+	} else {
+		printSummary(results)
+	}
+
+	return failedResults(results)
+}
+
+/*
+	history [flags] list | remove <series> | set <series> <episode> | watched <series> <episodes> | unwatched <series> <episodes>
+*/
+func runHistory(args []string) error {
+	fs    := newFlagSet("history", "[flags] list | remove <series> | set <series> <episode> | watched <series> <episodes> | unwatched <series> <episodes>", "Show or change the watching history, <series> is an id or a slug and <episodes> a range like 3-7,10")
+	flags := addCommonFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	action := fs.Arg(0)
+	if action == "" {
+		action = "list"
+	}
+
+	if *flags.json {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*flags.userName)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		history := u.GetHistory()
+		if *flags.json {
+			printJSON(history)
+			return nil
+		}
+
+		if len(history) == 0 {
+			fmt.Println("You are not watching any series")
+			return nil
+		}
+
+		for i, h := range history {
+			watched := formatEpisodeRanges(h.WatchedNumbers())
+			if watched == "" {
+				watched = "none"
+			}
+
+			fmt.Printf("%d) %s - %s: watched %s, next %d [%s]\n", i+1, h.SeriesName, h.SeriesSlug, watched, h.NextUnwatched(), h.Provider)
+		}
+
+	case "remove":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			return errors.New("missing series")
+		}
+
+		for _, h := range u.GetHistory() {
+			if h.SeriesID != fs.Arg(1) && h.SeriesSlug != fs.Arg(1) {
+				continue
+			}
+
+			if _, err := u.RemoveHistory(h.Provider, h.SeriesID); err != nil {
+				return err
+			}
+
+			fmt.Printf("❌ Removed %s from the history\n", h.SeriesName)
+			return nil
+		}
+
+		return fmt.Errorf("series %s not found in the history", fs.Arg(1))
+
+	case "set":
+		if fs.NArg() != 3 {
+			fs.Usage()
+			return errors.New("missing series or episode")
+		}
+
+		number, err := strconv.ParseUint(fs.Arg(2), 10, 16)
+		if err != nil || number == 0 {
+			return fmt.Errorf("invalid episode %s", fs.Arg(2))
+		}
+
+		provider, err := flags.setup()
+		if err != nil {
+			return err
+		}
+
+		series, err := resolveSeries(provider, historySeries(*flags.userName, provider.Name()), fs.Arg(1), seriesFilter{Interactive: !*flags.json})
+		if err != nil {
+			return err
+		}
+
+		// the episode id is best effort, the history works with the number alone
+		episode := models.Episode{Number: uint16(number)}
+		if episodes, err := provider.GetEpisodes(appContext(), series, uint(number), uint(number)); err == nil {
+			for _, e := range episodes {
+				if e.Number == episode.Number {
+					episode = e
+					break
+				}
+			}
+		}
+
+		// every episode up to the given one is watched, the ones after it are not
+		if err := u.SetWatchedUpTo(provider.Name(), series, episode); err != nil {
+			return err
+		}
+
+		fmt.Printf("✅ %s set to episode %d\n", series.Name, episode.Number)
+
+	case "watched":
+		if fs.NArg() != 3 {
+			fs.Usage()
+			return errors.New("missing series or episodes")
+		}
+
+		numbers, err := parseEpisodeRanges(fs.Arg(2))
+		if err != nil {
+			return err
+		}
+
+		provider, err := flags.setup()
+		if err != nil {
+			return err
+		}
+
+		series, err := resolveSeries(provider, historySeries(*flags.userName, provider.Name()), fs.Arg(1), seriesFilter{Interactive: !*flags.json})
+		if err != nil {
+			return err
+		}
+
+		// the episode ids are best effort, the history works with the numbers alone
+		byNumber := map[uint16]models.Episode{}
+		if available, err := provider.GetEpisodes(appContext(), series, uint(numbers[0]), uint(numbers[len(numbers)-1])); err == nil {
+			for _, e := range available {
+				byNumber[e.Number] = e
+			}
+		}
+
+		episodes := make([]models.Episode, 0, len(numbers))
+		for _, number := range numbers {
+			episode, ok := byNumber[number]
+			if !ok {
+				episode = models.Episode{Number: number}
+			}
+			episodes = append(episodes, episode)
+		}
+
+		if err := u.MarkWatched(provider.Name(), series, episodes...); err != nil {
+			return err
+		}
+
+		fmt.Printf("✅ %s: episodes %s marked as watched\n", series.Name, formatEpisodeRanges(numbers))
+
+	case "unwatched":
+		if fs.NArg() != 3 {
+			fs.Usage()
+			return errors.New("missing series or episodes")
+		}
+
+		numbers, err := parseEpisodeRanges(fs.Arg(2))
+		if err != nil {
+			return err
+		}
+
+		for _, h := range u.GetHistory() {
+			if h.SeriesID != fs.Arg(1) && h.SeriesSlug != fs.Arg(1) {
+				continue
+			}
+
+			if _, err := u.MarkUnwatched(h.Provider, h.SeriesID, numbers...); err != nil {
+				return err
+			}
+
+			fmt.Printf("✅ %s: episodes %s marked as not watched\n", h.SeriesName, formatEpisodeRanges(numbers))
+			return nil
+		}
+
+		return fmt.Errorf("series %s not found in the history", fs.Arg(1))
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown history action %s", action)
+	}
+
+	return nil
+}
+
+/*
+	clean [flags] <series>
+*/
+func runClean(args []string) error {
+	fs     := newFlagSet("clean", "[flags] <series>", "Delete the already watched episodes of a series given as id or slug")
+	flags  := addCommonFlags(fs)
+	before := fs.Uint("before", 0, "Delete the episodes before this one instead of the watched ones")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("missing series")
+	}
+
+	if *flags.json {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*flags.userName)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range u.GetHistory() {
+		if h.SeriesID != fs.Arg(0) && h.SeriesSlug != fs.Arg(0) {
+			continue
+		}
+
+		limit := h.NextUnwatched()
+		if *before > 0 {
+			limit = uint16(*before)
+		}
+
+		deleteEpisodesBefore(u.RootDir, h.Provider, h.Series(), limit)
+		return nil
+	}
+
+	if *before == 0 {
+		return fmt.Errorf("series %s not found in the history, use --before", fs.Arg(0))
+	}
+
+	for _, s := range library.GetInstance(u.RootDir).Series() {
+		if s.SeriesID == fs.Arg(0) || s.SeriesSlug == fs.Arg(0) {
+			deleteEpisodesBefore(u.RootDir, s.Provider, models.Series{ID: s.SeriesID, Name: s.SeriesName, Slug: s.SeriesSlug}, uint16(*before))
+			return nil
+		}
+	}
+
+	deleteEpisodesBefore(u.RootDir, "", models.Series{Slug: fs.Arg(0)}, uint16(*before))
+	return nil
+}
+
+/*
+	serve [flags] [address]
+*/
+func runServe(args []string) error {
+	fs       := newFlagSet("serve", "[flags] [address]", "Run as a daemon exposing the HTTP API, default address "+DEFAULT_SERVE_ADDRESS)
+	userName := fs.String("user", "", "User.env file for configuration loading")
+	quality  := addQualityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := applyQuality(*quality); err != nil {
+		return err
+	}
+
+	address := fs.Arg(0)
+	if address == "" {
+		address = DEFAULT_SERVE_ADDRESS
+	}
+
+	return server.Start(appContext(), address, *userName)
+}
+
+/*
+	config [flags] [key [value]]
+*/
+func runConfig(args []string) error {
+	fs       := newFlagSet("config", "[flags] [key [value]]", "Show the user configuration, a single key or set a key")
+	userName := fs.String("user", "", "User.env file for configuration loading")
+	jsonMode := fs.Bool("json", false, "Print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *jsonMode {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*userName)
+	if err != nil {
+		return err
+	}
+
+	switch fs.NArg() {
+	case 0:
+		config, err := u.GetConfig()
+		if err != nil {
+			return err
+		}
+
+		if *jsonMode {
+			printJSON(config)
+			return nil
+		}
+
+		keys := make([]string, 0, len(config))
+		for key := range config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Printf("# %s\n", u.EnvFile)
+		for _, key := range keys {
+			fmt.Printf("%s=%s\n", key, config[key])
+		}
+
+	case 1:
+		config, err := u.GetConfig()
+		if err != nil {
+			return err
+		}
+
+		value, ok := config[fs.Arg(0)]
+		if !ok {
+			return fmt.Errorf("%s is not set", fs.Arg(0))
+		}
+
+		if *jsonMode {
+			printJSON(map[string]string{fs.Arg(0): value})
+			return nil
+		}
+
+		fmt.Println(value)
+
+	case 2:
+		if err := u.SetConfig(fs.Arg(0), fs.Arg(1)); err != nil {
+			return err
+		}
+
+		fmt.Printf("✅ %s=%s\n", fs.Arg(0), fs.Arg(1))
+
+	default:
+		fs.Usage()
+		return errors.New("too many arguments")
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IceWizard98/series_downloader/models/user"
+)
+
+/*
+	The commands load the user profile, keep it and its files in a temporary home
+*/
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "series_downloader-test")
+	if err != nil {
+		panic(err)
+	}
+
+	os.Setenv("HOME", home)
+	os.Setenv("USER_ROOT_DIR", filepath.Join(home, "downloads"))
+	os.Setenv("DOWNLOAD_NEXT_EPISODES", "0")
+	os.MkdirAll(filepath.Join(home, "downloads"), os.ModePerm)
+
+	code := m.Run()
+
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+/*
+	The arguments of every command are checked before anything is searched or downloaded
+*/
+func TestCommandArguments(t *testing.T) {
+	for _, test := range []struct {
+		run  func(args []string) error
+		args []string
+		err  string
+	}{
+		{runSearch, nil, "missing title"},
+		{runSearch, []string{"--provider", "animeunity"}, "missing title"},
+
+		{runEpisodes, nil, "missing series"},
+		{runEpisodes, []string{"naruto", "1-3"}, "missing series"},
+
+		{runDownload, nil, "missing series or episodes range"},
+		{runDownload, []string{"naruto"}, "missing series or episodes range"},
+		{runDownload, []string{"--pick", "2", "naruto"}, "missing series or episodes range"},
+		{runDownload, []string{"naruto", "7-3"}, "invalid episode range"},
+		{runDownload, []string{"naruto", "some"}, "invalid episode"},
+		{runDownload, []string{"--quality", "high", "naruto", "1"}, "invalid quality high"},
+		// the flags go before the arguments
+		{runDownload, []string{"naruto", "1", "--pick", "2"}, "missing series or episodes range"},
+
+		{runHistory, []string{"bogus"}, "unknown history action bogus"},
+		{runHistory, []string{"remove"}, "missing series"},
+		{runHistory, []string{"remove", "naruto"}, "series naruto not found in the history"},
+		{runHistory, []string{"set", "naruto"}, "missing series or episode"},
+		{runHistory, []string{"set", "naruto", "x"}, "invalid episode x"},
+		{runHistory, []string{"set", "naruto", "70000"}, "invalid episode 70000"},
+		{runHistory, []string{"watched", "naruto"}, "missing series or episodes"},
+		{runHistory, []string{"watched", "naruto", "0-3"}, "invalid episode range"},
+		{runHistory, []string{"unwatched", "naruto"}, "missing series or episodes"},
+		{runHistory, []string{"unwatched", "naruto", "x"}, "invalid episode"},
+		{runHistory, []string{"unwatched", "naruto", "3"}, "series naruto not found in the history"},
+
+		{runClean, nil, "missing series"},
+		{runClean, []string{"naruto", "boruto"}, "missing series"},
+		{runClean, []string{"naruto"}, "series naruto not found in the history, use --before"},
+
+		{runQueue, []string{"retry", "x"}, "invalid job id x"},
+		{runQueue, []string{"drop", "1", "-2"}, "invalid job id -2"},
+		{runQueue, []string{"--quality", "high"}, "invalid quality high"},
+
+		{runLibrary, []string{"bogus"}, "unknown action bogus"},
+
+		{runSync, nil, "DOWNLOAD_NEXT_EPISODES is 0"},
+		{runSync, []string{"--quality", "high"}, "invalid quality high"},
+
+		{runVerify, []string{"--quality", "high"}, "invalid quality high"},
+
+		{runServe, []string{"--quality", "high"}, "invalid quality high"},
+
+		{runConfig, []string{"a", "b", "c"}, "too many arguments"},
+		{runConfig, []string{"NOT_SET_KEY"}, "NOT_SET_KEY is not set"},
+
+		{runWatch, []string{"--quality", "high"}, "invalid quality high"},
+	} {
+		err := test.run(test.args)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got error %v, want %q", test.args, err, test.err)
+		}
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	if err := runConfig([]string{"TEST_CONFIG_KEY", "value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runConfig([]string{"TEST_CONFIG_KEY"}); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := user.GetInstance("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := u.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config["TEST_CONFIG_KEY"] != "value" {
+		t.Errorf("got TEST_CONFIG_KEY=%q, want value", config["TEST_CONFIG_KEY"])
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/library"
+	"github.com/IceWizard98/series_downloader/models/user"
+	progressbar "github.com/IceWizard98/series_downloader/utils/progressBar"
+)
+
+type followedSeries struct {
+	provider string
+	series   models.Series
+}
+
+type libraryOutput struct {
+	Series []library.SeriesEntry `json:"series"`
+	Size   int64                 `json:"size"`
+}
+
+/*
+	library [flags] list | scan
+*/
+func runLibrary(args []string) error {
+	fs    := newFlagSet("library", "[flags] list | scan", "Show the episodes on disk per series with the gaps and the size, scan indexes the files of the series in the history and forgets the deleted ones")
+	flags := addCommonFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	action := fs.Arg(0)
+	if action == "" {
+		action = "list"
+	}
+
+	if *flags.json {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*flags.userName)
+	if err != nil {
+		return err
+	}
+
+	lib := library.GetInstance(u.RootDir)
+
+	switch action {
+	case "list":
+		// printed below, as after a scan
+
+	case "scan":
+		followed := []followedSeries{}
+		for _, h := range u.GetHistory() {
+			followed = append(followed, followedSeries{h.Provider, h.Series()})
+		}
+
+		added, removed := scanLibrary(lib, u.RootDir, followed)
+		fmt.Printf("🔄 Library updated: %d episodes added, %d removed\n", added, removed)
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %s", action)
+	}
+
+	output := libraryOutput{Series: lib.Series()}
+	for _, series := range output.Series {
+		output.Size += series.Size
+	}
+
+	if *flags.json {
+		printJSON(output)
+		return nil
+	}
+
+	if len(output.Series) == 0 {
+		fmt.Println("The library is empty")
+		return nil
+	}
+
+	for _, series := range output.Series {
+		numbers := make([]uint16, 0, len(series.Episodes))
+		for _, e := range series.Episodes {
+			numbers = append(numbers, e.Number)
+		}
+
+		fmt.Printf("%s (%s) [%s]: %d episodes %s, %s\n", series.SeriesName, series.SeriesSlug, series.Provider, len(numbers), formatEpisodeRanges(numbers), progressbar.FormatBytes(series.Size))
+		if len(series.Gaps) > 0 {
+			fmt.Printf("\t⚠️ missing %s\n", formatEpisodeRanges(series.Gaps))
+		}
+	}
+
+	fmt.Printf("Total: %s\n", progressbar.FormatBytes(output.Size))
+	return nil
+}
+
+/*
+	Adds the episodes on disk of the series in the history that are not in the library
+	and removes the entries whose file is gone
+*/
+func scanLibrary(lib *library.Library, rootDir string, followed []followedSeries) (int, int) {
+	gone := []string{}
+	for _, entry := range lib.Entries() {
+		if _, err := os.Stat(entry.Path); err != nil {
+			gone = append(gone, entry.Path)
+		}
+	}
+
+	if err := lib.Remove(gone...); err != nil {
+		fmt.Printf("⚠️ Error updating the library: \n\t- %s\n", err)
+	}
+
+	added := 0
+	for _, f := range followed {
+		series := f.series
+
+		files, err := models.EpisodeFiles(rootDir, series)
+		if err != nil {
+			fmt.Printf("⚠️ Error reading the episodes of %s: \n\t- %s\n", series.Name, err)
+			continue
+		}
+
+		for number, paths := range files {
+			episode := models.Episode{Number: number}
+			path    := models.EpisodePath(rootDir, series, episode)
+			if !slices.Contains(paths, path) {
+				path = models.TSPath(path)
+			}
+
+			// only the complete files, not the partial downloads
+			if _, ok := lib.Find(f.provider, series.ID, number); ok || !slices.Contains(paths, path) {
+				continue
+			}
+
+			quality, _ := models.RecordedQuality(rootDir, series, episode)
+			if _, err := lib.Add(f.provider, series, episode, path, quality); err != nil {
+				fmt.Printf("⚠️ Error adding %s to the library: \n\t- %s\n", path, err)
+				continue
+			}
+			added++
+		}
+	}
+
+	return added, len(gone)
+}
+
+/*
+	Formats sorted episode numbers as ranges, e.g. 1-12, 15
+*/
+func formatEpisodeRanges(numbers []uint16) string {
+	ranges := []string{}
+	for i := 0; i < len(numbers); {
+		j := i
+		for j+1 < len(numbers) && numbers[j+1] == numbers[j]+1 {
+			j++
+		}
+
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d", numbers[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", numbers[i], numbers[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(ranges, ", ")
+}
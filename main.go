@@ -1,342 +1,223 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"math"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
-	"unicode"
+	"syscall"
 
 	"github.com/IceWizard98/series_downloader/models"
-	"github.com/IceWizard98/series_downloader/models/animeunity"
-	"github.com/IceWizard98/series_downloader/models/user"
+	_ "github.com/IceWizard98/series_downloader/models/animeunity"
+	"github.com/IceWizard98/series_downloader/models/hooks"
 	"github.com/IceWizard98/series_downloader/utils/routinepoll"
-	"github.com/skratchdot/open-golang/open"
 )
 
-func searchForSeries(animeUnityInstance *animeunity.AnimeUnity, title string) (models.Series, error) {
+const (
+	EXIT_ERROR       = 1
+	EXIT_AMBIGUOUS   = 2
+	EXIT_INTERRUPTED = 130
 
-	if title == "" || len(title) == 0 {
-		return models.Series{}, fmt.Errorf("please provide sires title with --title flag")
-	}
-
-	seriesList, err := animeUnityInstance.Search(title)
-	if err != nil {
-		return models.Series{}, err
-	}
-
-	if len(seriesList) == 0 {
-		return models.Series{}, fmt.Errorf("no results found")
-	}
-
-	for i, v := range seriesList {
-		fmt.Printf("%d - %s\n", i+1, v.Slug)
-	}
-
-	fmt.Println("Select a series")
-	reader := bufio.NewReader(os.Stdin)
-
-	selected, _ := reader.ReadString('\n')
-	selected = strings.TrimSpace(selected)
+	STATUS_DOWNLOADED = "downloaded"
+	STATUS_SKIPPED    = "skipped"
+	STATUS_FAILED     = "failed"
+)
 
-	if selected == "" || len(selected) == 0 {
-		return models.Series{}, fmt.Errorf("invalid selection")
-	}
+type downloadResult struct {
+	Episode uint16 `json:"episode"`
+	Status  string `json:"status"`
+	Path    string `json:"path,omitempty"`
+	Quality string `json:"quality,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
 
-	for _, char := range selected {
-		if !unicode.IsDigit(char) {
-			return models.Series{}, fmt.Errorf("only digit are allowed")
-		}
-	}
+type jsonOutput struct {
+	Provider string           `json:"provider"`
+	Series   models.Series    `json:"series"`
+	Episodes []downloadResult `json:"episodes"`
+}
 
-	index_selected, err := strconv.ParseUint(selected, 10, 16)
-	if err != nil {
-		return models.Series{}, fmt.Errorf("invalid selection")
-	}
+type command struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
 
-	if index_selected < 1 || uint16(index_selected) > uint16(len(seriesList)) {
-		return models.Series{}, fmt.Errorf("invalid selection")
+var commands []command
+
+func init() {
+	commands = []command{
+		{"watch",    "Search or pick a series, play an episode and download the next ones (default)", runWatch},
+		{"search",   "Search a series",                                                               runSearch},
+		{"episodes", "List the episodes of a series",                                                 runEpisodes},
+		{"download", "Download episodes, e.g. download naruto 3-7,10",                                runDownload},
+		{"history",  "Show or change the watching history",                                           runHistory},
+		{"clean",    "Delete the already watched episodes of a series",                               runClean},
+		{"sync",     "Download the next episodes of every followed series",                           runSync},
+		{"queue",    "Show, retry or drop the jobs of the download queue",                            runQueue},
+		{"library",  "Show the episodes on disk with the gaps and the total size",                    runLibrary},
+		{"verify",   "Check the downloaded episodes and download the damaged ones again",             runVerify},
+		{"serve",    "Run as a daemon exposing the HTTP API",                                         runServe},
+		{"config",   "Show or change the user configuration",                                         runConfig},
 	}
-
-	return seriesList[index_selected-1], nil
 }
 
-func main() {
-	series_title := flag.String("title", "", "Series title")
-	userName     := flag.String("user", "", "User.env file for configuration loading")
-	delete_prev  := flag.Bool("delete", false, "Delete previus episodes")
-	list         := flag.Bool("list", false, "Show list of following series")
+// stdout before enableJSON, where the JSON result is written
+var jsonOut = os.Stdout
 
-	flag.Parse()
+/*
+	Moves the human readable messages to stderr so stdout only carries the JSON result
+*/
+func enableJSON() {
+	os.Stdout = os.Stderr
+}
 
-	user, err := user.GetInstance(*userName)
+func printJSON(v any) {
+	encoder := json.NewEncoder(jsonOut)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
 
-	if err != nil {
-		fmt.Printf("⚠️ %s\n", err)
-		os.Exit(1)
+func newFlagSet(name string, usage string, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s\n\nUsage: %s %s %s\n\nFlags:\n", description, os.Args[0], name, usage)
+		fs.PrintDefaults()
 	}
 
-	var selectedSeries models.Series
-	animeUnityInstance, err := animeunity.Init()
+	return fs
+}
 
-	if err != nil {
-		fmt.Printf("⚠️ %s\n", err)
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [args]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.description)
 	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> --help' for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command the flags of 'watch' are accepted, e.g. %s --title \"Naruto\"\n", os.Args[0])
+}
 
-	if *list {
-		watchingSeries := user.GetHistory()
-
-		if len(watchingSeries) == 0 {
-			fmt.Println("You are not watching any series")
-			os.Exit(1)
-		}
-
-		for i, h := range watchingSeries {
-			fmt.Printf("%d) %s - %s: %d\n", i+1, h.SeriesName, h.SeriesSlug, h.EpisodeNumber)
-		}
-
-		fmt.Println("Select a series")
-		reader := bufio.NewReader(os.Stdin)
+/*
+	Context of the main routine pool, cancelled on SIGINT/SIGTERM
+*/
+func appContext() context.Context {
+	return routinepoll.GetInstance().Context()
+}
 
-		selected, _ := reader.ReadString('\n')
-		selected = strings.TrimSpace(selected)
+// closed when the routine pool stopped after a SIGINT/SIGTERM
+var stopped = make(chan struct{})
+
+/*
+	On the first SIGINT/SIGTERM the routine pool is cancelled: the running downloads
+	stop keeping their .part file for the next run and the queued ones are skipped.
+	main exits once they are done, a second signal exits immediately
+*/
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		fmt.Fprintln(os.Stderr, "\n❌ Interrupted, stopping the downloads... press Ctrl+C again to force")
+
+		go func() {
+			<-signals
+			os.Exit(EXIT_INTERRUPTED)
+		}()
+
+		routinepoll.GetInstance().CancelAll()
+		close(stopped)
+	}()
+}
 
-		if selected == "" || len(selected) == 0 {
-			fmt.Printf("⚠️ Invalid selection\n")
-			os.Exit(1)
-		}
+/*
+	Waits for the downloads to stop, saving their partial state, and for the hooks,
+	then exits with EXIT_INTERRUPTED
+*/
+func exitInterrupted() {
+	<-stopped
+	hooks.Wait()
+	os.Exit(EXIT_INTERRUPTED)
+}
 
-		for _, char := range selected {
-			if !unicode.IsDigit(char) {
-				fmt.Printf("⚠️ Only digit are allowed\n")
-				os.Exit(1)
+func main() {
+	handleSignals()
+
+	args := os.Args[1:]
+	run  := runWatch
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		found := false
+		for _, c := range commands {
+			if c.name == args[0] {
+				run   = c.run
+				args  = args[1:]
+				found = true
+				break
 			}
 		}
 
-		index_selected, err := strconv.ParseUint(selected, 10, 16)
-		if err != nil {
-			fmt.Printf("⚠️ Invalid selection\n")
-			os.Exit(1)
-		}
-
-		if index_selected < 1 || uint16(index_selected) > uint16(len(watchingSeries)) {
-			fmt.Printf("⚠️ Invalid selection\n")
-			os.Exit(1)
-		}
-
-		toWatch := watchingSeries[index_selected-1]
-		selectedSeries = models.Series{
-      ID       : toWatch.SeriesID,
-      Name     : toWatch.SeriesName,
-      Slug     : toWatch.SeriesSlug,
-      Episodes : uint(toWatch.SeriesTotEpisodes),
+		if !found && args[0] == "help" {
+			printUsage()
+			return
 		}
-	} else {
-		var err error
 
-		if selectedSeries, err = searchForSeries(animeUnityInstance, *series_title); err != nil {
-			fmt.Printf("⚠️ Error retriving series \n\t- %s\n", err)
-			os.Exit(1)
+		if !found {
+			fmt.Fprintf(os.Stderr, "unknown command %s\n\n", args[0])
+			printUsage()
+			os.Exit(EXIT_ERROR)
 		}
 	}
 
-	var selectedEpisode models.Episode
-	toContinue := false
-	for _, v := range user.GetHistory() {
-		if v.SeriesID == selectedSeries.ID {
-			fmt.Printf("Current episode: %d\n", v.EpisodeNumber)
-			fmt.Println("Do you want to whatch the next episode? (y/n)")
-			reader := bufio.NewReader(os.Stdin)
-
-			to_continue, _ := reader.ReadString('\n')
-			to_continue = strings.TrimSpace(to_continue)
-			to_continue = strings.ToLower(to_continue)
-
-			if to_continue == "y" {
-				selectedEpisode = models.Episode{
-					ID:     v.EpisodeID,
-					Number: v.EpisodeNumber,
-				}
-				toContinue = true
-			}
-		}
-	}
+	err := run(args)
 
-	downloadNextNEpisodes := os.Getenv("DOWNLOAD_NEXT_EPISODES")
+	// the hooks of the last downloads may still be running
+	hooks.Wait()
 
-	for _, char := range downloadNextNEpisodes {
-		if !unicode.IsDigit(char) {
-			fmt.Println("⚠️ Only digit are allowed in DOWNLOAD_NEXT_EPISODES")
-		}
+	if appContext().Err() != nil {
+		exitInterrupted()
 	}
 
-	nextNEpisodes, err := strconv.ParseUint(downloadNextNEpisodes, 10, 16)
 	if err != nil {
-		fmt.Printf("⚠️ Error parsing %s: %s\n", downloadNextNEpisodes, err)
+		exitWithError("⚠️ %s\n", err)
 	}
+}
 
-	endEpisode := uint(selectedEpisode.Number) + uint(nextNEpisodes)
-	fmt.Printf("End episode: %d\n", endEpisode)
-	var episodes []models.Episode
-	if toContinue {
-		fmt.Printf("Continue watching episode %d\n", selectedEpisode.Number+1)
-		selectedEpisode = models.Episode{
-			Number: selectedEpisode.Number + 1,
-		}
-
-		// GET ONLY WHAT NEEDED N = SELECTED.NUMBER
-		var err error
-		episodes, err = animeUnityInstance.GetEpisodes(selectedSeries, uint(selectedEpisode.Number), endEpisode)
-
-		if err != nil {
-			fmt.Printf("⚠️ Error retriving episodes \n\t- %s\n", err)
-			fmt.Println("Continue to watch locally")
-		}
-	} else {
-		var err error
-		episodes, err = animeUnityInstance.GetEpisodes(selectedSeries, 1, math.MaxUint)
-		if err != nil {
-			fmt.Printf("⚠️ Error retriving episodes \n\t- %s\n", err)
-			os.Exit(1)
-		}
-
-		if len(episodes) == 0 {
-			fmt.Println("No episodes found")
-			os.Exit(1)
-		}
-
-		for i, v := range episodes {
-			fmt.Printf("%d - %d\n", i+1, v.Number)
-		}
-
-		reader      := bufio.NewReader(os.Stdin)
-		selected, _ := reader.ReadString('\n')
-		selected     = strings.TrimSpace(selected)
-
-		if selected == "" || len(selected) == 0 {
-			fmt.Println("Invalid selection")
-			os.Exit(1)
-		}
-
-		for _, char := range selected {
-			if !unicode.IsDigit(char) {
-				fmt.Println("Only digit are allowed")
-				os.Exit(1)
-			}
-		}
-
-		index_selected, err := strconv.ParseUint(selected, 10, 16)
-		if err != nil {
-			fmt.Println("Invalid selection")
-			os.Exit(1)
-		}
-
-		if index_selected < 1 || uint16(index_selected) > uint16(len(episodes)) {
-			fmt.Println("Invalid selection")
-			os.Exit(1)
-		}
+func searchForSeries(provider models.Provider, title string, filter seriesFilter) (models.Series, error) {
 
-		selectedEpisode = episodes[index_selected-1]
+	if title == "" || len(title) == 0 {
+		return models.Series{}, fmt.Errorf("please provide sires title with --title flag")
 	}
 
-	pool := routinepoll.GetInstance()
-
-	pool.AddTask(func() {
-		func(episode models.Episode) {
-			fmt.Printf("⬇️ Downloading episode %d\n", episode.Number)
-			path, error := animeUnityInstance.DownloadEpisode(episode, user.RootDir)
-
-			if error != nil {
-				fmt.Printf("⚠️ Error downloading episode %d: \n\t- %s\n", episode.Number, error)
-				return
-			}
-
-			fmt.Printf("✅ Episode downloaded: %d\n", episode.Number)
-			stat, err := os.Stat(path)
-			if err != nil || stat.Size() <= 0 || stat.IsDir() {
-				fmt.Printf("⚠️ Error reading file to Play episode %s: \nerror %s\nsize %d\n", path, err, stat.Size())
-				return
-			}
+	seriesList, err := provider.Search(appContext(), title)
+	if err != nil {
+		return models.Series{}, err
+	}
 
-			if err := open.Run(path); err != nil {
-				fmt.Printf("⚠️ Error opening file to Play episode %s: \n\t- %s\n", path, err)
-				return
-			}
-			user.AddHistory("animeunity", selectedSeries, episode)
-		}(selectedEpisode)
+	return selectSeries(seriesList, filter, func(i int, v models.Series) string {
+		return fmt.Sprintf("%d - %s", i+1, v.Slug)
 	})
+}
 
-
-	// The iterator starts at 0, but the first episode has number = 1 and is at index 0 in the slice.
-	// This means we can simply add the iterator to the number of episodes already downloaded —
-	// the result will correctly match the index in the slice.
-	fmt.Printf("⬇️ Downloading next %d episodes\n", nextNEpisodes)
-
-	downloadNext := pool.AddSubGroup("download_next", uint(nextNEpisodes), 5)
-	defer downloadNext.Close()
-
-	for _, episode := range episodes {
-
-		if episode.Number == selectedEpisode.Number || episode.Number < selectedEpisode.Number {
-			continue
-		}
-
-		if uint(episode.Number) > endEpisode || nextNEpisodes == 0 {
-			break
-		}
-
-		ep := episode
-		downloadNext.AddTask(func() {
-			fmt.Printf("⬇️ Downloading episode %d\n", ep.Number)
-
-			_, error := animeUnityInstance.DownloadEpisode(ep, user.RootDir)
-
-			if error != nil {
-				fmt.Printf("⚠️ Error downloading episode %d: \n\t- %s\n", ep.Number, error)
-				return
-			}
-
-			fmt.Printf("✅ Episode downloaded: %d\n", ep.Number)
-		})
-
-		nextNEpisodes--
-	}
-
-	if *delete_prev {
-		basePath := fmt.Sprintf("%s/%s", user.RootDir, selectedSeries.Slug)
-		files, err := os.ReadDir(basePath)
-		if err != nil {
-			fmt.Printf("⚠️ Error reading directory to delete %s: \n\t- %s\n", basePath, err)
-		} else {
-			deletePrev := pool.AddSubGroup("delete_prev", uint(len(files)), 1)
-			defer deletePrev.Close()
-		  for _, file := range files {
-				f := file
-		  	deletePrev.AddTask(func() {
-					episodeNumber, err := strconv.Atoi(strings.Split(f.Name(), ".")[0])
-					if err != nil {
-						fmt.Printf("⚠️ Error parsing file name to delete %s: \n\t- %s\n", f.Name(), err)
-						return
-					}
-
-					if episodeNumber >= int(selectedEpisode.Number) {
-						return
-					}
-
-					fmt.Printf("❌ Deleting file %s\n", basePath+"/"+f.Name())
-
-					if err := os.Remove(basePath + "/" + f.Name()); err != nil {
-						fmt.Printf("⚠️ Error deleting file %s: \n\t- %s\n", basePath+"/"+f.Name(), err)
-					}
-		  	})
-		  }
-		}
+/*
+	Prints the error and exits, with EXIT_AMBIGUOUS when the
+	choice had to be made on stdin but the prompt is disabled
+	and EXIT_INTERRUPTED when it follows a SIGINT/SIGTERM
+*/
+func exitWithError(format string, err error) {
+	if appContext().Err() != nil {
+		exitInterrupted()
 	}
 
-	pool.WaitAll()
+	fmt.Printf(format, err)
 
-	// TODO: currently useless but filter must be updated on --serve version
+	if errors.Is(err, errAmbiguous) {
+		os.Exit(EXIT_AMBIGUOUS)
+	}
+	os.Exit(EXIT_ERROR)
 }
+
@@ -1,7 +1,7 @@
 package models
 
 type Episode struct {
-	ID          uint   
-	Number      uint16 
-	EpisodeCode string   
+	ID          uint   `json:"id"`
+	Number      uint16 `json:"number"`
+	EpisodeCode string `json:"episode_code"`
 }
@@ -0,0 +1,254 @@
+package models
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_NAMING_TEMPLATE = "{series_slug}/{number}.mp4"
+	// the HLS downloads in MPEG-TS have it in place of the extension of the template, see httpclient
+	TS_EXTENSION = ".ts"
+)
+
+var (
+	placeholderRe = regexp.MustCompile(`\{([a-z_]+)(?::(\d+))?\}`)
+	// characters not allowed in a file name on the common file systems
+	unsafeNameRe  = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1f]`)
+
+	// suffixes of the partial downloads of an episode, see httpclient
+	partialSuffixes = `(?:\.part|\.part\.json|\.hls)?`
+	// extensions of the metadata sidecars, replacing the one of the video, see metadata
+	sidecarExtensions = `\.(?:nfo|json)`
+
+	// the last invalid template, to warn only once about it
+	invalidTemplate   string
+	invalidTemplateMu sync.Mutex
+)
+
+/*
+	Returns NAMING_TEMPLATE from the environment, the path of an episode relative to the user root dir.
+	Placeholders: {series_name}, {series_slug}, {series_id} and {number}, {number:02} pads it to 2 digits.
+	DEFAULT_NAMING_TEMPLATE is used when unset or invalid
+*/
+func NamingTemplate() string {
+	template := os.Getenv("NAMING_TEMPLATE")
+	if template == "" {
+		return DEFAULT_NAMING_TEMPLATE
+	}
+
+	if err := ValidateNamingTemplate(template); err != nil {
+		invalidTemplateMu.Lock()
+		if invalidTemplate != template {
+			invalidTemplate = template
+			fmt.Printf("⚠️ Invalid NAMING_TEMPLATE, using %s: \n\t- %s\n", DEFAULT_NAMING_TEMPLATE, err)
+		}
+		invalidTemplateMu.Unlock()
+
+		return DEFAULT_NAMING_TEMPLATE
+	}
+
+	return template
+}
+
+/*
+	A template must name every episode of a series differently and stay under the root dir
+*/
+func ValidateNamingTemplate(template string) error {
+	if strings.HasPrefix(template, "/") || strings.Contains(template, "..") {
+		return fmt.Errorf("%s must be relative to USER_ROOT_DIR", template)
+	}
+
+	hasNumber, hasSeries := false, false
+	for _, match := range placeholderRe.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "number":
+			hasNumber = true
+		case "series_name", "series_slug", "series_id":
+			hasSeries = true
+			if match[2] != "" {
+				return fmt.Errorf("{%s} can't have a width", match[1])
+			}
+		default:
+			return fmt.Errorf("unknown placeholder {%s}", match[1])
+		}
+	}
+
+	if !hasNumber {
+		return fmt.Errorf("%s has no {number}", template)
+	}
+
+	if !hasSeries {
+		return fmt.Errorf("%s has no {series_name}, {series_slug} or {series_id}", template)
+	}
+
+	return nil
+}
+
+/*
+	Returns where an episode of series is saved under rootDir
+*/
+func EpisodePath(rootDir string, series Series, episode Episode) string {
+	return filepath.Join(rootDir, renderTemplate(NamingTemplate(), series, &episode))
+}
+
+/*
+	Returns the directory holding every episode of series: the directories of the
+	template before the first one that depends on the episode, rootDir if the first does
+*/
+func SeriesDir(rootDir string, series Series) string {
+	dirs := strings.Split(NamingTemplate(), "/")
+
+	static := []string{}
+	for _, dir := range dirs[:len(dirs)-1] {
+		if strings.Contains(dir, "{number") {
+			break
+		}
+		static = append(static, dir)
+	}
+
+	if len(static) == 0 {
+		return filepath.Clean(rootDir)
+	}
+
+	return filepath.Join(rootDir, renderTemplate(strings.Join(static, "/"), series, nil))
+}
+
+/*
+	Returns path with the .ts extension, where an episode is saved when it's an MPEG-TS stream
+*/
+func TSPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + TS_EXTENSION
+}
+
+/*
+	Returns the number of the episode saved at path, the reverse of EpisodePath.
+	The partial downloads (.part, .part.json and .hls) and the metadata sidecars of an episode match too
+*/
+func ParseEpisodePath(rootDir string, series Series, path string) (uint16, bool) {
+	match := episodePathRegexp(rootDir, series).FindStringSubmatch(filepath.ToSlash(filepath.Clean(path)))
+	if match == nil {
+		return 0, false
+	}
+
+	number, err := strconv.ParseUint(match[1], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint16(number), true
+}
+
+/*
+	Returns the files, the partial downloads and the sidecars of every episode of series found under rootDir, by episode number
+*/
+func EpisodeFiles(rootDir string, series Series) (map[uint16][]string, error) {
+	files     := map[uint16][]string{}
+	pattern   := episodePathRegexp(rootDir, series)
+	seriesDir := SeriesDir(rootDir, series)
+
+	err := filepath.WalkDir(seriesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == seriesDir && os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+
+		match := pattern.FindStringSubmatch(filepath.ToSlash(filepath.Clean(path)))
+		if match == nil || path == seriesDir {
+			return nil
+		}
+
+		if number, err := strconv.ParseUint(match[1], 10, 16); err == nil {
+			files[uint16(number)] = append(files[uint16(number)], path)
+		}
+
+		// the segments of an HLS download
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+/*
+	Renders template for series, placeholders of the episode are left untouched when episode is nil
+*/
+func renderTemplate(template string, series Series, episode *Episode) string {
+	return placeholderRe.ReplaceAllStringFunc(template, func(placeholder string) string {
+		match := placeholderRe.FindStringSubmatch(placeholder)
+
+		switch match[1] {
+		case "series_name":
+			return safeName(series.Name)
+		case "series_slug":
+			return safeName(series.Slug)
+		case "series_id":
+			return safeName(series.ID)
+		case "number":
+			if episode == nil {
+				return placeholder
+			}
+			width, _ := strconv.Atoi(match[2])
+			return fmt.Sprintf("%0*d", width, episode.Number)
+		}
+
+		return placeholder
+	})
+}
+
+/*
+	Matches the paths rendered by the template for series, the first group is the episode number
+*/
+func episodePathRegexp(rootDir string, series Series) *regexp.Regexp {
+	template := NamingTemplate()
+	pattern  := "^" + regexp.QuoteMeta(filepath.ToSlash(filepath.Clean(rootDir)) + "/")
+
+	last := 0
+	for _, loc := range placeholderRe.FindAllStringSubmatchIndex(template, -1) {
+		pattern += regexp.QuoteMeta(template[last:loc[0]])
+		last     = loc[1]
+
+		name := template[loc[2]:loc[3]]
+		if name != "number" {
+			pattern += regexp.QuoteMeta(renderTemplate(template[loc[0]:loc[1]], series, nil))
+			continue
+		}
+
+		width := 1
+		if loc[4] >= 0 {
+			width, _ = strconv.Atoi(template[loc[4]:loc[5]])
+		}
+		pattern += fmt.Sprintf(`(\d{%d,})`, max(width, 1))
+	}
+
+	// the sidecars and the MPEG-TS videos have the extension of the template replaced
+	tail := template[last:]
+	ext  := filepath.Ext(tail)
+	pattern += regexp.QuoteMeta(strings.TrimSuffix(tail, ext)) + "(?:(?:" + regexp.QuoteMeta(ext) + "|" + regexp.QuoteMeta(TS_EXTENSION) + ")" + partialSuffixes + "|" + sidecarExtensions + ")$"
+
+	return regexp.MustCompile(pattern)
+}
+
+/*
+	Removes from a name the characters that can't be in a file name
+*/
+func safeName(name string) string {
+	name = unsafeNameRe.ReplaceAllString(name, "")
+	name = strings.TrimRight(strings.TrimSpace(name), ".")
+
+	if name == "" {
+		return "_"
+	}
+
+	return name
+}
@@ -0,0 +1,65 @@
+package models
+
+import "time"
+
+/*
+	Progress of an episode download
+*/
+type Progress struct {
+	Series  string        `json:"series"`
+	Episode uint16        `json:"episode"`
+	Done    int64         `json:"done"`
+	Total   int64         `json:"total"` // -1 when unknown
+	Speed   float64       `json:"speed"` // bytes per second
+	ETA     time.Duration `json:"eta"`   // 0 when unknown
+}
+
+/*
+	Receives the progress events of a download
+*/
+type ProgressFunc func(progress Progress)
+
+/*
+	Adapts the bytes written by a transfer into Progress events of an episode,
+	computing the speed as a moving average between two calls.
+	Returns nil when onProgress is nil
+*/
+func TrackProgress(series Series, episode Episode, onProgress ProgressFunc) func(done int64, total int64) {
+	if onProgress == nil {
+		return nil
+	}
+
+	lastDone := int64(-1)
+	lastTime := time.Time{}
+	speed    := float64(0)
+
+	return func(done int64, total int64) {
+		now := time.Now()
+
+		// a restarted transfer goes back to zero, that's not a speed sample
+		if elapsed := now.Sub(lastTime).Seconds(); lastDone >= 0 && done >= lastDone && elapsed > 0 {
+			sample := float64(done - lastDone) / elapsed
+			if speed == 0 {
+				speed = sample
+			} else {
+				speed = 0.7*speed + 0.3*sample
+			}
+		}
+
+		lastDone, lastTime = done, now
+
+		var eta time.Duration
+		if total > 0 && speed > 0 && done <= total {
+			eta = time.Duration(float64(total - done) / speed * float64(time.Second))
+		}
+
+		onProgress(Progress{
+			Series:  series.Slug,
+			Episode: episode.Number,
+			Done:    done,
+			Total:   total,
+			Speed:   speed,
+			ETA:     eta,
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const DEFAULT_PROVIDER = "animeunity"
+
+/*
+	A Provider is a source of series: it can search them, list their episodes
+	and download a single episode to disk.
+	Every call stops when ctx is cancelled
+*/
+type Provider interface {
+	Name() string
+	Search(ctx context.Context, query string) ([]Series, error)
+	GetEpisodes(ctx context.Context, series Series, start uint, end uint) ([]Episode, error)
+	DownloadEpisode(ctx context.Context, series Series, episode Episode, rootDir string, onProgress ProgressFunc) (string, error)
+}
+
+type ProviderFactory func() (Provider, error)
+
+var (
+	providersMu        sync.Mutex
+	providerFactories = map[string]ProviderFactory{}
+	providerInstances = map[string]Provider{}
+)
+
+/*
+	Registers a provider factory under the given name.
+	Providers call this from their init function
+*/
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if factory == nil {
+		panic("nil factory for provider " + name)
+	}
+
+	if _, exists := providerFactories[name]; exists {
+		panic("provider already registered: " + name)
+	}
+
+	providerFactories[name] = factory
+}
+
+/*
+	Returns the provider registered with the given name, initializing it on first use.
+	An empty name selects DEFAULT_PROVIDER.
+	The provider can be returned together with an error when it was created but
+	failed to initialize, so callers can still use it for offline operations
+*/
+func GetProvider(name string) (Provider, error) {
+	if name == "" {
+		name = DEFAULT_PROVIDER
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if provider, ok := providerInstances[name]; ok {
+		return provider, nil
+	}
+
+	factory, ok := providerFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %s, available providers: %v", name, providersList())
+	}
+
+	provider, err := factory()
+	if provider != nil {
+		providerInstances[name] = provider
+	}
+
+	return provider, err
+}
+
+/*
+	Returns the sorted names of every registered provider
+*/
+func ProvidersList() []string {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	return providersList()
+}
+
+func providersList() []string {
+	names := make([]string, 0, len(providerFactories))
+	for name := range providerFactories {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Vertical resolution of a video (480 for 480p), QUALITY_BEST and QUALITY_WORST
+	select the highest and the lowest available
+*/
+type Quality int
+
+const (
+	QUALITY_BEST  Quality = 0
+	QUALITY_WORST Quality = -1
+	// the resolution of the file is not known
+	QUALITY_UNKNOWN Quality = -2
+
+	QUALITY_FILE = "/.quality"
+)
+
+var (
+	qualityRe      = regexp.MustCompile(`(?i)^(\d{3,4})p?$`)
+	qualityInUrlRe = regexp.MustCompile(`(?i)[^0-9](2160|1440|1080|720|480|360|240)p`)
+
+	qualityFileMu sync.Mutex
+)
+
+/*
+	Parses "best", "worst", "480p" or "480"
+*/
+func ParseQuality(value string) (Quality, error) {
+	value = strings.TrimSpace(value)
+
+	switch strings.ToLower(value) {
+	case "", "best":
+		return QUALITY_BEST, nil
+	case "worst":
+		return QUALITY_WORST, nil
+	}
+
+	match := qualityRe.FindStringSubmatch(value)
+	if match == nil {
+		return QUALITY_BEST, fmt.Errorf("invalid quality %s, use best, worst or a resolution like 720p", value)
+	}
+
+	height, _ := strconv.Atoi(match[1])
+	return Quality(height), nil
+}
+
+/*
+	Returns PREFERRED_QUALITY from the environment, QUALITY_BEST when unset or invalid
+*/
+func PreferredQuality() Quality {
+	quality, err := ParseQuality(os.Getenv("PREFERRED_QUALITY"))
+	if err != nil {
+		fmt.Printf("⚠️ Error parsing PREFERRED_QUALITY: %s\n", err)
+	}
+
+	return quality
+}
+
+/*
+	Guesses the quality from a url or a file name like Naruto_Ep_01_720p.mp4
+*/
+func QualityFromUrl(url string) Quality {
+	match := qualityInUrlRe.FindStringSubmatch(url)
+	if match == nil {
+		return QUALITY_UNKNOWN
+	}
+
+	height, _ := strconv.Atoi(match[1])
+	return Quality(height)
+}
+
+func (q Quality) String() string {
+	switch q {
+	case QUALITY_BEST:
+		return "best"
+	case QUALITY_WORST:
+		return "worst"
+	case QUALITY_UNKNOWN:
+		return "unknown"
+	}
+
+	return fmt.Sprintf("%dp", int(q))
+}
+
+/*
+	Returns the index of the available quality closest to q, on a tie the higher one.
+	The unknown ones are ignored, -1 when none is known
+*/
+func (q Quality) Closest(available []Quality) int {
+	best := -1
+	for i, quality := range available {
+		if quality <= 0 {
+			continue
+		}
+
+		if best < 0 {
+			best = i
+			continue
+		}
+
+		current := available[best]
+		switch q {
+		case QUALITY_BEST:
+			if quality > current { best = i }
+		case QUALITY_WORST:
+			if quality < current { best = i }
+		default:
+			distance, bestDistance := abs(int(quality - q)), abs(int(current - q))
+			if distance < bestDistance || (distance == bestDistance && quality > current) {
+				best = i
+			}
+		}
+	}
+
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+/*
+	Saves the quality an episode was downloaded at, in the .quality file of the series directory
+	keyed by the path of the episode relative to it
+*/
+func RecordQuality(rootDir string, series Series, episode Episode, quality Quality) error {
+	qualityFileMu.Lock()
+	defer qualityFileMu.Unlock()
+
+	seriesDir := SeriesDir(rootDir, series)
+	qualities := readQualities(seriesDir + QUALITY_FILE)
+	qualities[qualityKey(seriesDir, rootDir, series, episode)] = quality.String()
+
+	return writeQualities(seriesDir + QUALITY_FILE, qualities)
+}
+
+/*
+	Returns the quality recorded for an episode, false if it was never recorded
+*/
+func RecordedQuality(rootDir string, series Series, episode Episode) (string, bool) {
+	qualityFileMu.Lock()
+	defer qualityFileMu.Unlock()
+
+	seriesDir   := SeriesDir(rootDir, series)
+	quality, ok := readQualities(seriesDir + QUALITY_FILE)[qualityKey(seriesDir, rootDir, series, episode)]
+	return quality, ok
+}
+
+/*
+	Removes the recorded quality of the episodes numbered before the given one
+*/
+func ForgetQualities(rootDir string, series Series, before uint16) error {
+	qualityFileMu.Lock()
+	defer qualityFileMu.Unlock()
+
+	seriesDir := SeriesDir(rootDir, series)
+	qualities := readQualities(seriesDir + QUALITY_FILE)
+	removed   := false
+	for key := range qualities {
+		if n, ok := ParseEpisodePath(rootDir, series, seriesDir + "/" + key); ok && n < before {
+			delete(qualities, key)
+			removed = true
+		}
+	}
+
+	if !removed {
+		return nil
+	}
+
+	return writeQualities(seriesDir + QUALITY_FILE, qualities)
+}
+
+func qualityKey(seriesDir string, rootDir string, series Series, episode Episode) string {
+	return strings.TrimPrefix(EpisodePath(rootDir, series, episode), seriesDir + "/")
+}
+
+func readQualities(path string) map[string]string {
+	qualities := map[string]string{}
+
+	content, err := os.ReadFile(path)
+	if err == nil {
+		_ = json.Unmarshal(content, &qualities)
+	}
+
+	return qualities
+}
+
+func writeQualities(path string, qualities map[string]string) error {
+	content, _ := json.Marshal(qualities)
+	if err := os.WriteFile(path + ".tmp", content, 0664); err != nil {
+		return err
+	}
+
+	return os.Rename(path + ".tmp", path)
+}
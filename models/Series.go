@@ -1,9 +1,13 @@
 package models
 
 type Series struct {
-	ID       string  
-	Name     string
-	ImageURL string
-	Episodes uint  
-	Slug     string
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	ImageURL string   `json:"image_url"`
+	Episodes uint     `json:"episodes"`
+	Slug     string   `json:"slug"`
+	// optional, filled when the provider has them
+	Plot     string   `json:"plot,omitempty"`
+	Year     uint16   `json:"year,omitempty"`
+	Genres   []string `json:"genres,omitempty"`
 }
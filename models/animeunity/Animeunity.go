@@ -2,34 +2,54 @@ package animeunity
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 
 	"github.com/IceWizard98/series_downloader/models"
 	"github.com/IceWizard98/series_downloader/models/httpclient"
+	"github.com/IceWizard98/series_downloader/models/library"
+	"github.com/IceWizard98/series_downloader/models/metadata"
 	bloomfilter "github.com/IceWizard98/series_downloader/utils/bloomFilter"
 	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+	videocheck "github.com/IceWizard98/series_downloader/utils/videoCheck"
 	"github.com/PuerkitoBio/goquery"
 )
 
+const PROVIDER_NAME = "animeunity"
+
 type AnimeUnity struct {
-	client   *httpclient.APIClient
-	anime    anime
+	client *httpclient.APIClient
+}
+
+func init() {
+	models.RegisterProvider(PROVIDER_NAME, func() (models.Provider, error) {
+		return Init()
+	})
 }
 
 type anime struct {
-	ID          uint   `json:"id"                  `
-	Name        string `json:"title_eng"           `
-	ImageURL    string `json:"imageurl"            `
-	Episodes    uint   `json:"real_episodes_count" `
-	Slug        string `json:"slug"                `
+	ID          uint    `json:"id"                  `
+	Name        string  `json:"title_eng"           `
+	ImageURL    string  `json:"imageurl"            `
+	Episodes    uint    `json:"real_episodes_count" `
+	Slug        string  `json:"slug"                `
+	Plot        string  `json:"plot"                `
+	Date        string  `json:"date"                `
+	Genres      []genre `json:"genres"              `
+}
+
+type genre struct {
+	Name string `json:"name"`
 }
 
 type episode struct {
@@ -52,29 +72,35 @@ func Init() (*AnimeUnity, error) {
 	}
 	
 	instance.client = client
+	// search results and episode lists, to work offline and fetch them less often
+	instance.client.Cache = httpclient.NewResponseCache(PROVIDER_NAME)
 	
 	if !instance.client.Initialized {
-		err := instance.client.Initialize()
+		err := instance.client.Initialize(context.Background())
 		if err != nil {
-			instance.client = nil
-			return instance, fmt.Errorf("error initializing animeunity http client: \n\t- %s", err)
+			// the client is kept: the cached catalog is still there and the session is opened again on the next request
+			return instance, fmt.Errorf("error initializing animeunity http client, using the cached catalog: \n\t- %s", err)
 		}
 	}
 
 	return instance, nil
 }
 
+func (a AnimeUnity) Name() string {
+	return PROVIDER_NAME
+}
+
 /*
 	Search for animes by title using the API endpoint
   The result is a list of models.Series
 */
-func (a AnimeUnity) Search( query string ) ([]models.Series, error) {
+func (a AnimeUnity) Search( ctx context.Context, query string ) ([]models.Series, error) {
 	if a.client == nil {
 		return make([]models.Series, 0), nil
 	}
 
 	search        := fmt.Sprintf(`{"title":"%s"}`, query)
-	response, err := a.client.DoRequest("POST", "/livesearch", search)
+	response, err := a.client.DoCachedRequest(ctx, "POST", "/livesearch", search)
 
 	if err != nil {
 		return nil, fmt.Errorf("error searching for %s: \n\t- %s", query, err)
@@ -99,22 +125,33 @@ func (a AnimeUnity) Search( query string ) ([]models.Series, error) {
 
 	var animeModels []models.Series
 	for _, v := range animeList {
+		// the date is the year, e.g. "2002"
+		year, _ := strconv.ParseUint(v.Date, 10, 16)
+
+		genres := make([]string, 0, len(v.Genres))
+		for _, g := range v.Genres {
+			genres = append(genres, g.Name)
+		}
+
 		animeModels = append(animeModels, models.Series{
 			ID:       fmt.Sprintf("%d", v.ID),
 			Name:     v.Name,
 			ImageURL: v.ImageURL,
 			Episodes: v.Episodes,
 			Slug:     v.Slug,
+			Plot:     v.Plot,
+			Year:     uint16(year),
+			Genres:   genres,
 		})
 	}
 
 	return animeModels, nil
 }
 
-func (a *AnimeUnity) SetAnime(animeModel models.Series) {
+func toAnime(animeModel models.Series) anime {
 	numberId, _ := strconv.ParseUint(animeModel.ID, 10, 64)
 
-	a.anime = anime{
+	return anime{
 		ID:       uint(numberId),
 		Name:     animeModel.Name,
 		ImageURL: animeModel.ImageURL,
@@ -122,14 +159,14 @@ func (a *AnimeUnity) SetAnime(animeModel models.Series) {
 		Slug:     animeModel.Slug,
 	}
 }
+
 /*
   Get the anime episodes using the API endpoint
 	The result is a list of models.Episode
 */
-func (a *AnimeUnity) GetEpisodes( animeModel models.Series, start uint, end uint ) ([]models.Episode, error) {
-	a.SetAnime(animeModel)
-
-	totEpisodes := a.anime.Episodes
+func (a *AnimeUnity) GetEpisodes( ctx context.Context, animeModel models.Series, start uint, end uint ) ([]models.Episode, error) {
+	anime       := toAnime(animeModel)
+	totEpisodes := anime.Episodes
 
 	if totEpisodes == 0 {
 		return make([]models.Episode, 0), nil
@@ -139,24 +176,30 @@ func (a *AnimeUnity) GetEpisodes( animeModel models.Series, start uint, end uint
 		return make([]models.Episode, 0), nil
 	}
 
-	if !a.client.Initialized {
-		err := a.client.Initialize()
-		if err != nil {
-			return nil, fmt.Errorf("error initializing client: \n\t- %s", err)
-		}
+	if end > totEpisodes || end == 0 {
+		end = totEpisodes
 	}
 
-	pool := routinepoll.GetInstance()
-	ch   := make(chan []byte)
+	if start > end {
+		return make([]models.Episode, 0), nil
+	}
 
-	if end > totEpisodes || end == 0 {
-		end = totEpisodes
+	// the chunks always start at 1, 121, 241... so the same ranges are requested,
+	// and found in the cache, whatever episode the caller starts from
+	first := uint(1)
+	if start > 0 {
+		first = (start - 1) / 120 * 120 + 1
 	}
 
-	for i := start; i <= end; i += 120 {
-		pool.AddTask( func() {
+	// buffered so an early return doesn't leave the requests blocked on send
+	pool   := routinepoll.GetInstance()
+	chunks := (end - first) / 120 + 1
+	ch     := make(chan []byte, chunks)
+
+	for i := first; i <= end; i += 120 {
+		added := pool.AddTask( func() {
 			func(ch chan<- []byte, start uint) {
-  	    response, err := a.client.DoRequest("GET", fmt.Sprintf("/info_api/%d/1?start_range=%d&end_range=%d", a.anime.ID, start, start+119), "")
+  	    response, err := a.client.DoCachedRequest(ctx, "GET", fmt.Sprintf("/info_api/%d/1?start_range=%d&end_range=%d", anime.ID, start, start+119), "")
 
   	    if err != nil {
 		    	ch <- []byte("null")
@@ -166,32 +209,43 @@ func (a *AnimeUnity) GetEpisodes( animeModel models.Series, start uint, end uint
   	    ch <- response
 			}(ch, i)
 		})
-	}
 
-	go func() {
-		pool.Wait()
-    close(ch)
-  }()
+		if !added {
+			ch <- []byte("null")
+		}
+	}
 
 	var episodesList []models.Episode
 	/*
-		Iterate over the channel to get the episodes and convert them to models.Episode
+		Receive a response per chunk and convert them to models.Episode.
+		Only the chunks of this call are waited, the pool may run other tasks,
+		and a cancelled pool skips the queued ones
 	*/
-	for res := range ch {
+	for range chunks {
+		var res []byte
+
+		select {
+		case res = <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pool.Context().Done():
+			return nil, pool.Context().Err()
+		}
+
 		if string(res) == "null" || res == nil || len(res) == 0 {
-			return nil, fmt.Errorf("error searching for %s from %d to %d: \n\t- Response is empty", a.anime.Name, start, end)
+			return nil, fmt.Errorf("error searching for %s from %d to %d: \n\t- Response is empty", anime.Name, start, end)
 		}
 
 		var resultJson map[string]json.RawMessage
 		err := json.Unmarshal(res, &resultJson)
 	  if err != nil {
-			return nil, fmt.Errorf("on base response unmarshal %s: \n\t- %s", a.anime.Name, err)
+			return nil, fmt.Errorf("on base response unmarshal %s: \n\t- %s", anime.Name, err)
 	  }
 
 	  var episodesListChunk []episode
 	  err = json.Unmarshal(resultJson["episodes"], &episodesListChunk)
 	  if err != nil {
-			return nil, fmt.Errorf("on unmarshal episodes %s: \n\t- %s", a.anime.Name, err)
+			return nil, fmt.Errorf("on unmarshal episodes %s: \n\t- %s", anime.Name, err)
 	  }
 
 	  for _, v := range episodesListChunk {
@@ -200,6 +254,9 @@ func (a *AnimeUnity) GetEpisodes( animeModel models.Series, start uint, end uint
 	    }
 
 	    number := uint16(episodeNumber)
+			if uint(number) < start {
+				continue
+			}
 
 			episode := models.Episode{
 				ID:          v.ID,
@@ -219,22 +276,33 @@ func (a *AnimeUnity) GetEpisodes( animeModel models.Series, start uint, end uint
 }
 
 /*
-	Download an episode using the API endpoint and save it to disk
+	Download an episode of the given series using the API endpoint and save it to disk
 */
-func (a AnimeUnity) DownloadEpisode( episode models.Episode, rootDir string ) (string, error) {
-  basePath := fmt.Sprintf(rootDir + "/%s", a.anime.Slug)
-	fileName := fmt.Sprintf("%d.mp4", episode.Number)
-	fullPath := basePath + "/" + fileName
+func (a AnimeUnity) DownloadEpisode( ctx context.Context, animeModel models.Series, episode models.Episode, rootDir string, onProgress models.ProgressFunc ) (string, error) {
+	anime    := toAnime(animeModel)
+	fullPath := models.EpisodePath(rootDir, animeModel, episode)
+	basePath := filepath.Dir(fullPath)
 
 	filter := bloomfilter.GetInstance()
+	lib    := library.GetInstance(rootDir)
 
+	// the library knows the episode even if it was saved with another naming template
+	if entry, ok := lib.Find(a.Name(), animeModel.ID, episode.Number); ok {
+		return entry.Path, nil
+	}
+
+	// downloaded before the library was there, index it
 	if filter.Contains([]byte(fullPath)) {
 		if _, err := os.Stat(fullPath); err == nil {
+			quality, _ := models.RecordedQuality(rootDir, animeModel, episode)
+			if _, err := lib.Add(a.Name(), animeModel, episode, fullPath, quality); err != nil {
+				fmt.Printf("⚠️ Error adding %s to the library: \n\t- %s\n", fullPath, err)
+			}
 			return fullPath, nil
 		}
 	}
 
-	if a.anime.ID == 0 {
+	if anime.ID == 0 {
 		return "", errors.New("anime id is 0")
 	}
 
@@ -242,11 +310,15 @@ func (a AnimeUnity) DownloadEpisode( episode models.Episode, rootDir string ) (s
 		return "", errors.New("episode id is 0")
 	}
 
-	if a.anime.Slug == "" {
+	if anime.Slug == "" {
 		return "", errors.New("anime slug is empty")
 	}
 
-  response, err := a.client.DoRequest("GET", fmt.Sprintf("/anime/%d-%s/%d", a.anime.ID, a.anime.Slug, episode.ID), "")
+	if a.client == nil {
+		return "", errors.New("client not initialized")
+	}
+
+  response, err := a.client.DoRequest(ctx, "GET", fmt.Sprintf("/anime/%d-%s/%d", anime.ID, anime.Slug, episode.ID), "")
   if err != nil {
   	return "", err
  	}
@@ -278,7 +350,7 @@ func (a AnimeUnity) DownloadEpisode( episode models.Episode, rootDir string ) (s
 
 	var embedHtml []byte
 	{
-	  req, err := http.NewRequest("GET", embedUrl, nil)
+	  req, err := http.NewRequestWithContext(ctx, "GET", embedUrl, nil)
 	  if err != nil {
 	  	return "", fmt.Errorf("error creating request: \n\t- %s", err) 
 	  }
@@ -308,8 +380,10 @@ func (a AnimeUnity) DownloadEpisode( episode models.Episode, rootDir string ) (s
 
 	// find the download url and use it to download the episond and saavi it into a file
 	var downloadUrl string
+	var scripts     string
 	embedDoc.Find("script").Each(func(i int, s *goquery.Selection) {
 		content := s.Text()
+		scripts += content + "\n"
 		re := regexp.MustCompile(`window.downloadUrl\s*=\s*['"]([^"]+)['"]`)
     match := re.FindStringSubmatch(content)
 
@@ -318,54 +392,172 @@ func (a AnimeUnity) DownloadEpisode( episode models.Episode, rootDir string ) (s
     }
 	})
 
-	if downloadUrl == "" {
+	// some players expose only the HLS stream
+	playlistUrl := findPlaylistUrl(scripts)
+
+	if downloadUrl == "" && playlistUrl == "" {
 	  return "", errors.New("download url not found")
 	}
 
-	{
-    resp, err := http.Get(downloadUrl)
-    if err != nil {
-			return "", fmt.Errorf("error getting download url: \n\t- %s", err)
-    }
-    defer resp.Body.Close()
+	err = os.MkdirAll(basePath, os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("error creating directory: \n\t- %s", err)
+	}
 
-    if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("invalid status code: %s", resp.Status)
-    }
+	quality, hlsHeight := a.resolveQuality(ctx, downloadUrl, playlistUrl, fullPath)
 
-		err = os.MkdirAll(basePath, os.ModePerm)
-		if err != nil {
-			return "", fmt.Errorf("error creating directory: \n\t- %s", err)
+	// an MPEG-TS stream is saved as .ts, not with the extension of the template
+	videoPath := fullPath
+
+	if hlsHeight < 0 {
+		// a partial download is kept on failure and resumed on the next attempt
+		err = httpclient.DownloadFile(ctx, http.DefaultClient, downloadUrl, fullPath, models.TrackProgress(animeModel, episode, onProgress))
+	} else {
+		hlsHeight, videoPath, err = httpclient.DownloadHLS(ctx, http.DefaultClient, playlistUrl, hlsHeight, fullPath, models.TrackProgress(animeModel, episode, onProgress))
+		if hlsHeight > 0 {
+			quality = models.Quality(hlsHeight)
 		}
+	}
+
+	if err != nil {
+		return "", err
+	}
 
-		downloadError := error
+	// a truncated video or an error page saved as the episode is downloaded again on the next attempt
+	if err := videocheck.Verify(videoPath); err != nil {
+		_ = os.Remove(videoPath)
+		return "", fmt.Errorf("invalid download of %s episode %d: \n\t- %s", animeModel.Name, episode.Number, err)
+	}
 
-		for {
-			outFile, err := os.Create(fullPath)
-			defer outFile.Close()
+	if err := models.RecordQuality(rootDir, animeModel, episode, quality); err != nil {
+		fmt.Printf("⚠️ Error saving quality of %s episode %d: \n\t- %s\n", animeModel.Name, episode.Number, err)
+	}
 
-			if err != nil {
-				downloadError = fmt.Errorf("error creating file: \n\t- %s", err)
-				break
-			}
+	if _, err := lib.Add(a.Name(), animeModel, episode, videoPath, quality.String()); err != nil {
+		fmt.Printf("⚠️ Error adding %s to the library: \n\t- %s\n", videoPath, err)
+	}
+
+	filter.Add([]byte(videoPath))
+	if err := filter.Save(""); err != nil {
+		fmt.Printf("⚠️ Error saving bloom filter: \n\t- %s\n", err)
+	}
+
+	a.exportMetadata(ctx, rootDir, animeModel, episode, videoPath)
+
+	return videoPath, nil
+}
+
+/*
+	Writes the metadata files of the episode and, the first time, of the series
+	as set by METADATA_FORMAT. The series from the history has no plot nor poster,
+	they are searched then
+*/
+func (a AnimeUnity) exportMetadata(ctx context.Context, rootDir string, animeModel models.Series, episode models.Episode, fullPath string) {
+	format := metadata.Format()
+	if format == "" {
+		return
+	}
 
-			_, err = io.Copy(outFile, resp.Body)
-			if err != nil {
-				downloadError = fmt.Errorf("error copying file: \n\t- %s", err)
-				break
+	if metadata.MissingSeries(rootDir, animeModel, format) {
+		if animeModel.Plot == "" && animeModel.ImageURL == "" {
+			if found, err := a.Search(ctx, animeModel.Name); err == nil {
+				for _, series := range found {
+					if series.ID == animeModel.ID {
+						animeModel = series
+						break
+					}
+				}
 			}
-			
-			break
 		}
 
-		if downloadError != nil {
-			if errOs := os.Remove(fullPath); errOs != nil {
-				return "",  fmt.Errorf("error deleting file %s: \n\t- %s\n\t- %s", fullPath, errOs, downloadError)
+		if err := metadata.WriteSeries(ctx, rootDir, a.Name(), animeModel, format); err != nil {
+			fmt.Printf("⚠️ Error writing the metadata of %s: \n\t- %s\n", animeModel.Name, err)
+		}
+	}
+
+	if err := metadata.WriteEpisode(a.Name(), animeModel, episode, fullPath, format); err != nil {
+		fmt.Printf("⚠️ Error writing the metadata of %s episode %d: \n\t- %s\n", animeModel.Name, episode.Number, err)
+	}
+}
+
+/*
+	Chooses between the direct download and the HLS renditions the closest to PREFERRED_QUALITY.
+	Returns the quality of the direct download and -1 when that's the one to use,
+	otherwise QUALITY_UNKNOWN and the height of the rendition (0 for the best).
+	With the best quality the direct download is used when there is one,
+	as it was before the renditions were considered, and so it is when its
+	partial file is there, to not download the episode again at another quality
+*/
+func (a AnimeUnity) resolveQuality(ctx context.Context, downloadUrl string, playlistUrl string, fullPath string) (models.Quality, int) {
+	preferred     := models.PreferredQuality()
+	directQuality := models.QualityFromUrl(downloadUrl)
+
+	if playlistUrl == "" || (downloadUrl != "" && preferred == models.QUALITY_BEST) {
+		return directQuality, -1
+	}
+
+	if _, err := os.Stat(fullPath + httpclient.PART_INFO_EXTENSION); err == nil && downloadUrl != "" {
+		return directQuality, -1
+	}
+
+	heights, err := httpclient.HLSRenditions(ctx, http.DefaultClient, playlistUrl)
+	if err != nil && downloadUrl != "" {
+		fmt.Printf("⚠️ Error reading the stream renditions, using the download url: \n\t- %s\n", err)
+		return directQuality, -1
+	}
+
+	// the direct download comes first so it wins a tie
+	available := []models.Quality{models.QUALITY_UNKNOWN}
+	if downloadUrl != "" {
+		available[0] = directQuality
+	}
+	for _, height := range heights {
+		available = append(available, models.Quality(height))
+	}
+
+	switch closest := preferred.Closest(available); {
+	case closest == 0:
+		return directQuality, -1
+	case closest > 0:
+		return models.QUALITY_UNKNOWN, heights[closest-1]
+	case downloadUrl != "":
+		return directQuality, -1
+	}
+
+	return models.QUALITY_UNKNOWN, 0
+}
+
+var (
+	masterPlaylistRe = regexp.MustCompile(`window\.masterPlaylist\s*=\s*\{[\s\S]*?url\s*:\s*['"]([^'"]+)['"]`)
+	playlistTokenRe  = regexp.MustCompile(`['"]?token['"]?\s*:\s*['"]([^'"]+)['"]`)
+	playlistExpireRe = regexp.MustCompile(`['"]?expires['"]?\s*:\s*['"]([^'"]+)['"]`)
+	canPlayFHDRe     = regexp.MustCompile(`window\.canPlayFHD\s*=\s*true`)
+	m3u8Re           = regexp.MustCompile(`https?://[^'"\s]+\.m3u8[^'"\s]*`)
+)
+
+/*
+	Finds the HLS master playlist in the scripts of the embed page:
+	window.masterPlaylist with its token and expiration, or any .m3u8 url
+*/
+func findPlaylistUrl(scripts string) string {
+	if match := masterPlaylistRe.FindStringSubmatch(scripts); len(match) > 1 {
+		playlistUrl, err := url.Parse(match[1])
+		if err == nil {
+			query := playlistUrl.Query()
+			if token := playlistTokenRe.FindStringSubmatch(scripts); len(token) > 1 {
+				query.Set("token", token[1])
+			}
+			if expires := playlistExpireRe.FindStringSubmatch(scripts); len(expires) > 1 {
+				query.Set("expires", expires[1])
+			}
+			if canPlayFHDRe.MatchString(scripts) {
+				query.Set("h", "1")
 			}
 
-			return "", downloadError
+			playlistUrl.RawQuery = query.Encode()
+			return playlistUrl.String()
 		}
 	}
 
-	return fullPath, nil
+	return m3u8Re.FindString(scripts)
 }
@@ -0,0 +1,178 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/utils/iceRoutinePool"
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+)
+
+const (
+	EVENT_DOWNLOADED = "episode_downloaded"
+	EVENT_FAILED     = "download_failed"
+
+	HOOKS_BUFFER    = 64
+	WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+/*
+	What happened to an episode, written as JSON on the stdin of the hook
+	command and posted to the webhook
+*/
+type Event struct {
+	Event    string         `json:"event"`
+	Provider string         `json:"provider"`
+	Series   models.Series  `json:"series"`
+	Episode  models.Episode `json:"episode"`
+	Path     string         `json:"path,omitempty"`
+	Quality  string         `json:"quality,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Time     time.Time      `json:"time"`
+}
+
+/*
+	Runs the hooks of a downloaded episode
+*/
+func Downloaded(provider string, series models.Series, episode models.Episode, path string, quality string) {
+	fire(Event{
+		Event:    EVENT_DOWNLOADED,
+		Provider: provider,
+		Series:   series,
+		Episode:  episode,
+		Path:     path,
+		Quality:  quality,
+		Time:     time.Now(),
+	})
+}
+
+/*
+	Runs the hooks of an episode whose download failed
+*/
+func Failed(provider string, series models.Series, episode models.Episode, err error) {
+	fire(Event{
+		Event:    EVENT_FAILED,
+		Provider: provider,
+		Series:   series,
+		Episode:  episode,
+		Error:    err.Error(),
+		Time:     time.Now(),
+	})
+}
+
+/*
+	Waits for the hooks still running, call it before exiting
+*/
+func Wait() {
+	if pool := routinepoll.GetInstance().GetSubGroup([]string{"hooks"}); pool != nil {
+		pool.Wait()
+	}
+}
+
+/*
+	Queues the hooks of event: the command of ON_EPISODE_DOWNLOADED or ON_DOWNLOAD_FAILED
+	and the webhook of HOOK_WEBHOOK_URL. They run one at a time in the "hooks" sub group
+	of the routine pool, so a slow script doesn't hold the downloads
+*/
+func fire(event Event) {
+	command := os.Getenv("ON_EPISODE_DOWNLOADED")
+	if event.Event == EVENT_FAILED {
+		command = os.Getenv("ON_DOWNLOAD_FAILED")
+	}
+	webhook := os.Getenv("HOOK_WEBHOOK_URL")
+
+	if command == "" && webhook == "" {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("⚠️ Error encoding the %s hook: \n\t- %s\n", event.Event, err)
+		return
+	}
+
+	pool := hooksPool()
+	pool.AddTask(func() {
+		if command != "" {
+			if err := runCommand(pool.Context(), command, event, payload); err != nil {
+				fmt.Printf("⚠️ Error running the %s hook for %s episode %d: \n\t- %s\n", event.Event, event.Series.Name, event.Episode.Number, err)
+			}
+		}
+
+		if webhook != "" {
+			if err := postWebhook(pool.Context(), webhook, payload); err != nil {
+				fmt.Printf("⚠️ Error calling the %s webhook for %s episode %d: \n\t- %s\n", event.Event, event.Series.Name, event.Episode.Number, err)
+			}
+		}
+	})
+}
+
+func hooksPool() *iceRoutinePool.IceRoutinePool {
+	return routinepoll.GetInstance().AddSubGroup("hooks", HOOKS_BUFFER, 1)
+}
+
+/*
+	Runs command with the shell, the event is in the environment and as JSON on stdin
+*/
+func runCommand(ctx context.Context, command string, event Event, payload []byte) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	cmd.Env = append(os.Environ(),
+		"EVENT="          + event.Event,
+		"PROVIDER="       + event.Provider,
+		"SERIES_ID="      + event.Series.ID,
+		"SERIES_NAME="    + event.Series.Name,
+		"SERIES_SLUG="    + event.Series.Slug,
+		"EPISODE_ID="     + strconv.FormatUint(uint64(event.Episode.ID), 10),
+		"EPISODE_NUMBER=" + strconv.FormatUint(uint64(event.Episode.Number), 10),
+		"EPISODE_PATH="   + event.Path,
+		"QUALITY="        + event.Quality,
+		"ERROR="          + event.Error,
+	)
+	cmd.Stdin  = bytes.NewReader(payload)
+	// os.Stdout is stderr in JSON mode, keep the output of the hook out of the result
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+/*
+	POSTs the event as JSON, any status other than 2xx is an error
+*/
+func postWebhook(ctx context.Context, url string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, WEBHOOK_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error creating request: \n\t- %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("invalid status code: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -1,41 +1,129 @@
 package httpclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// after a failure the server is not asked again for this long when the cache has the response
+	UNREACHABLE_DELAY        = 30 * time.Second
+	DEFAULT_MAX_RETRIES      = 3
+	DEFAULT_RETRY_BASE_DELAY = 500 * time.Millisecond
+	DEFAULT_RETRY_MAX_DELAY  = 10 * time.Second
+	ERROR_BODY_LIMIT         = 512
+)
+
 type APIClient struct {
 	BaseURL     string
 	Client      *http.Client
 	CSRFToken   string
 	Initialized bool
+
+	// attempts after the first one for timeouts, network errors, 408, 429 and 5xx
+	MaxRetries     int
+	// the delay doubles at every retry, up to RetryMaxDelay, with a random jitter
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+
+	// optional, used by DoCachedRequest
+	Cache *ResponseCache
+
+	mu sync.Mutex
+	// unix nanoseconds until which the server is considered down and the cache is used without asking it
+	unreachableUntil atomic.Int64
+}
+
+/*
+	A response of the server, notModified when it answered 304 to a revalidation
+*/
+type response struct {
+	body         []byte
+	etag         string
+	lastModified string
+	notModified  bool
 }
 
+/*
+	Creates a client for baseURL.
+	The retries can be configured with HTTP_MAX_RETRIES, HTTP_RETRY_BASE_DELAY
+	and HTTP_RETRY_MAX_DELAY (durations like 500ms or 10s)
+*/
 func NewAPIClient(baseURL string, timeout uint8) (*APIClient, error) {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating cookie jar: \n\t- %s", err)
 	}
 	
-	return &APIClient{
-		BaseURL:   baseURL,
-		Client:    &http.Client{Jar: jar, Timeout: time.Duration(timeout) * time.Second},
-		Initialized: false,
-	}, nil
+	client := &APIClient{
+		BaseURL:        baseURL,
+		Client:         &http.Client{Jar: jar, Timeout: time.Duration(timeout) * time.Second},
+		Initialized:    false,
+		MaxRetries:     DEFAULT_MAX_RETRIES,
+		RetryBaseDelay: DEFAULT_RETRY_BASE_DELAY,
+		RetryMaxDelay:  DEFAULT_RETRY_MAX_DELAY,
+	}
+
+	if retries, err := strconv.Atoi(os.Getenv("HTTP_MAX_RETRIES")); err == nil && retries >= 0 {
+		client.MaxRetries = retries
+	}
+
+	if delay, err := time.ParseDuration(os.Getenv("HTTP_RETRY_BASE_DELAY")); err == nil && delay > 0 {
+		client.RetryBaseDelay = delay
+	}
+
+	if delay, err := time.ParseDuration(os.Getenv("HTTP_RETRY_MAX_DELAY")); err == nil && delay > 0 {
+		client.RetryMaxDelay = delay
+	}
+
+	return client, nil
 }
 
-func (a *APIClient) Initialize() error {
-	resp, err := a.Client.Get(a.BaseURL)
+/*
+	Opens the session and reads the XSRF token from the cookies, with retries
+*/
+func (a *APIClient) Initialize(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.withRetry(ctx, a.initialize)
+	if err != nil && isRetryable(err) {
+		a.markUnreachable()
+	}
+
+	return err
+}
+
+/*
+	Single attempt of Initialize, a.mu must be held
+*/
+func (a *APIClient) initialize(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.BaseURL, nil)
 	if err != nil {
 		return fmt.Errorf("error initializing client: \n\t- %s", err)
 	}
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error initializing client: \n\t- %w", classifyError(err))
+	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("error initializing client: \n\t- %w", newStatusError(resp))
+	}
 	
 	u, _ := url.Parse(a.BaseURL)
 	cookies := a.Client.Jar.Cookies(u)
@@ -54,44 +142,273 @@ func (a *APIClient) Initialize() error {
 	return nil
 }
 
-func (a *APIClient) DoRequest(method, endpoint string, data string) ([]byte, error) {
+/*
+	Sends a request to the API and returns the response body.
+	Transient failures are retried with exponential backoff; when the session
+	expires (401/419) the client is initialized again once to refresh the token.
+	Non 2xx responses return a *StatusError
+*/
+func (a *APIClient) DoRequest(ctx context.Context, method, endpoint string, data string) ([]byte, error) {
+	resp, err := a.send(ctx, method, endpoint, data, nil)
+	return resp.body, err
+}
+
+/*
+	DoRequest through Cache, for the responses that can be reused (search results, episode lists).
+	A fresh entry is returned without asking the server, unless ctx is from WithRevalidate,
+	an expired one is revalidated with its ETag/Last-Modified, and any entry is returned
+	when the server can't be reached
+*/
+func (a *APIClient) DoCachedRequest(ctx context.Context, method, endpoint string, data string) ([]byte, error) {
+	if a.Cache == nil {
+		return a.DoRequest(ctx, method, endpoint, data)
+	}
+
+	key           := cacheKey(method, endpoint, data)
+	cached, found := a.Cache.get(key)
+
+	if found && ((a.Cache.fresh(cached) && !revalidate(ctx)) || a.unreachable()) {
+		return cached.Body, nil
+	}
+
+	var validators *cacheEntry
+	if found {
+		validators = &cached
+	}
+
+	resp, err := a.send(ctx, method, endpoint, data, validators)
+	if err != nil {
+		if !found || ctx.Err() != nil || !isRetryable(err) {
+			return nil, err
+		}
+
+		if !a.unreachable() {
+			fmt.Printf("🌐 %s unreachable, using the cached data: \n\t- %s\n", a.BaseURL, err)
+		}
+		a.markUnreachable()
+
+		return cached.Body, nil
+	}
+
+	if resp.notModified {
+		cached.StoredAt = time.Now()
+	} else {
+		cached = cacheEntry{
+			Key:          key,
+			Body:         resp.body,
+			ETag:         resp.etag,
+			LastModified: resp.lastModified,
+			StoredAt:     time.Now(),
+		}
+	}
+
+	if err := a.Cache.put(cached); err != nil {
+		fmt.Printf("⚠️ Error saving the cache of %s: \n\t- %s\n", endpoint, err)
+	}
+
+	return cached.Body, nil
+}
+
+/*
+	Sends a request with the session, retries and token refresh of DoRequest.
+	With validators the request is conditional and a 304 returns notModified
+*/
+func (a *APIClient) send(ctx context.Context, method, endpoint string, data string, validators *cacheEntry) (response, error) {
+	a.mu.Lock()
 	if !a.Initialized {
-		if err := a.Initialize(); err != nil {
-			return nil, fmt.Errorf("do request: \n\t- %s", err)
+		if err := a.withRetry(ctx, a.initialize); err != nil {
+			a.mu.Unlock()
+			return response{}, fmt.Errorf("do request: \n\t- %w", err)
 		}
 	}
-	
+	a.mu.Unlock()
+
+	refreshed := false
+	for {
+		var resp  response
+		var token string
+
+		err := a.withRetry(ctx, func(ctx context.Context) error {
+			var err error
+			resp, token, err = a.doRequest(ctx, method, endpoint, data, validators)
+			return err
+		})
+
+		if err == nil {
+			a.unreachableUntil.Store(0)
+			return resp, nil
+		}
+
+		if !errors.Is(err, ErrAuthExpired) || refreshed {
+			return response{}, err
+		}
+
+		refreshed = true
+		if err := a.refreshToken(ctx, token); err != nil {
+			return response{}, fmt.Errorf("do request: \n\t- %w", err)
+		}
+	}
+}
+
+/*
+	Single attempt of DoRequest, returns also the token it used
+*/
+func (a *APIClient) doRequest(ctx context.Context, method, endpoint string, data string, validators *cacheEntry) (response, string, error) {
 	var req *http.Request
 	var err error
 	
 	if data != "" {
-		req, err = http.NewRequest(method, a.BaseURL+endpoint, strings.NewReader(data))
+		req, err = http.NewRequestWithContext(ctx, method, a.BaseURL+endpoint, strings.NewReader(data))
 	} else {
-		req, err = http.NewRequest(method, a.BaseURL+endpoint, nil)
+		req, err = http.NewRequestWithContext(ctx, method, a.BaseURL+endpoint, nil)
 	}
 	
 	if err != nil {
-		return nil, fmt.Errorf("do request: \n\terror creating request: \n\t- %s", err)
+		return response{}, "", fmt.Errorf("do request: \n\terror creating request: \n\t- %s", err)
 	}
+
+	a.mu.Lock()
+	token := a.CSRFToken
+	a.mu.Unlock()
 	
 	if data != "" {
 		req.Header.Set("Content-Type", "application/json;charset=UTF-8")
 	}
-	req.Header.Set("X-XSRF-TOKEN", a.CSRFToken)
+	req.Header.Set("X-XSRF-TOKEN", token)
 	req.Header.Set("Accept", "application/json, text/plain, */*")
 	req.Header.Set("Origin", a.BaseURL)
 	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
 	
 	resp, err := a.Client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error doing request: \n\t- %s", err)
+		return response{}, token, fmt.Errorf("error doing request: \n\t- %w", classifyError(err))
 	}
 	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		return response{notModified: true}, token, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return response{}, token, newStatusError(resp)
+	}
 	
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: \n\t- %s", err)
+		return response{}, token, fmt.Errorf("error reading response body: \n\t- %w", classifyError(err))
 	}
 	
-	return body, nil
+	return response{
+		body:         body,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, token, nil
+}
+
+/*
+	Initializes the client again unless another request already replaced usedToken
+*/
+func (a *APIClient) refreshToken(ctx context.Context, usedToken string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.Initialized && a.CSRFToken != usedToken {
+		return nil
+	}
+
+	fmt.Println("🔑 Session expired, refreshing token")
+	// the server sends a new XSRF-TOKEN cookie that replaces the expired one
+	a.Initialized = false
+	a.CSRFToken   = ""
+
+	return a.withRetry(ctx, a.initialize)
+}
+
+/*
+	Runs attempt until it succeeds, fails with a non retryable error,
+	MaxRetries is reached or ctx is cancelled
+*/
+func (a *APIClient) withRetry(ctx context.Context, attempt func(ctx context.Context) error) error {
+	var err error
+	for retry := 0; ; retry++ {
+		if err = attempt(ctx); err == nil {
+			return nil
+		}
+
+		if retry >= a.MaxRetries || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		if err := sleep(ctx, a.backoff(retry, err)); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *APIClient) unreachable() bool {
+	return time.Now().UnixNano() < a.unreachableUntil.Load()
+}
+
+func (a *APIClient) markUnreachable() {
+	a.unreachableUntil.Store(time.Now().Add(UNREACHABLE_DELAY).UnixNano())
+}
+
+/*
+	Waits for delay, returns early with the context error when ctx is cancelled
+*/
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+/*
+	Exponential delay with jitter, a Retry-After header has precedence
+*/
+func (a *APIClient) backoff(retry int, err error) time.Duration {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		return min(statusErr.retryAfter, a.RetryMaxDelay)
+	}
+
+	delay := a.RetryBaseDelay << retry
+	if delay <= 0 || delay > a.RetryMaxDelay {
+		delay = a.RetryMaxDelay
+	}
+
+	// random between half and the full delay, so concurrent requests don't retry together
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LIMIT))
+
+	statusErr := &StatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       body,
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		statusErr.retryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return statusErr
 }
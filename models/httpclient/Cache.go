@@ -0,0 +1,157 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_CACHE_TTL = 6 * time.Hour
+	CACHE_DIR_NAME    = "series_downloader"
+)
+
+/*
+	A cached response with the validators to revalidate it
+*/
+type cacheEntry struct {
+	Key          string    `json:"key"`
+	Body         []byte    `json:"body"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	StoredAt     time.Time `json:"stored_at"`
+}
+
+/*
+	Responses saved on disk, one file per request.
+	An entry younger than TTL is used without asking the server, an older one is
+	revalidated with If-None-Match/If-Modified-Since and used as it is when the
+	server can't be reached
+*/
+type ResponseCache struct {
+	Dir string
+	TTL time.Duration
+
+	mu sync.Mutex
+}
+
+/*
+	Returns the directory of the caches: CACHE_DIR from the environment,
+	otherwise series_downloader in the user cache directory
+*/
+func CacheDir() string {
+	if dir := os.Getenv("CACHE_DIR"); dir != "" {
+		return dir
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, CACHE_DIR_NAME)
+}
+
+/*
+	Creates the cache named name under CacheDir.
+	The TTL is CACHE_TTL from the environment (a duration like 30m, 0 to always revalidate),
+	DEFAULT_CACHE_TTL when unset
+*/
+func NewResponseCache(name string) *ResponseCache {
+	cache := &ResponseCache{
+		Dir: filepath.Join(CacheDir(), name),
+		TTL: DEFAULT_CACHE_TTL,
+	}
+
+	if ttl, err := time.ParseDuration(os.Getenv("CACHE_TTL")); err == nil && ttl >= 0 {
+		cache.TTL = ttl
+	}
+
+	return cache
+}
+
+// context key of WithRevalidate
+type revalidateKey struct{}
+
+/*
+	Returns a context with which DoCachedRequest revalidates even the fresh entries,
+	for who needs the current data. The cache is still used when the server can't be reached
+*/
+func WithRevalidate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, revalidateKey{}, true)
+}
+
+func revalidate(ctx context.Context) bool {
+	value, _ := ctx.Value(revalidateKey{}).(bool)
+	return value
+}
+
+/*
+	Removes every entry
+*/
+func (c *ResponseCache) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return os.RemoveAll(c.Dir)
+}
+
+func (c *ResponseCache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry cacheEntry
+
+	content, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return entry, false
+	}
+
+	if err := json.Unmarshal(content, &entry); err != nil || entry.Key != key {
+		return cacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+/*
+	The entry is written aside and renamed so readers never see it half written
+*/
+func (c *ResponseCache) put(entry cacheEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.MkdirAll(c.Dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := c.path(entry.Key)
+	if err := os.WriteFile(path + ".tmp", content, 0664); err != nil {
+		return err
+	}
+
+	return os.Rename(path + ".tmp", path)
+}
+
+func (c *ResponseCache) fresh(entry cacheEntry) bool {
+	return time.Since(entry.StoredAt) < c.TTL
+}
+
+func (c *ResponseCache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(hash[:]) + ".json")
+}
+
+func cacheKey(method string, endpoint string, data string) string {
+	return method + " " + endpoint + " " + data
+}
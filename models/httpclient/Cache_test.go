@@ -0,0 +1,75 @@
+package httpclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	A fresh entry is used without asking the server, unless the context asks to revalidate it.
+	When the server is down the cache is still used
+*/
+func TestDoCachedRequestRevalidate(t *testing.T) {
+	var version, hits atomic.Int32
+	version.Store(1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.SetCookie(w, &http.Cookie{Name: "XSRF-TOKEN", Value: "token"})
+			return
+		}
+
+		hits.Add(1)
+		etag := `"` + string(rune('0' + version.Load())) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Write([]byte("episodes " + etag))
+	}))
+
+	client, err := NewAPIClient(server.URL, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.MaxRetries = 0
+	client.Cache      = &ResponseCache{Dir: t.TempDir(), TTL: time.Hour}
+
+	request := func(ctx context.Context, want string, wantHits int32) {
+		t.Helper()
+
+		body, err := client.DoCachedRequest(ctx, "POST", "/livesearch", `{"title":"naruto"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(body) != want {
+			t.Errorf("got %q, want %q", body, want)
+		}
+
+		if hits.Load() != wantHits {
+			t.Errorf("the server was asked %d times, want %d", hits.Load(), wantHits)
+		}
+	}
+
+	ctx := context.Background()
+	request(ctx, `episodes "1"`, 1)
+
+	// a new episode: the fresh entry hides it until it's revalidated
+	version.Store(2)
+	request(ctx, `episodes "1"`, 1)
+	request(WithRevalidate(ctx), `episodes "2"`, 2)
+	request(ctx, `episodes "2"`, 2)
+
+	// not modified
+	request(WithRevalidate(ctx), `episodes "2"`, 3)
+
+	server.Close()
+	request(WithRevalidate(ctx), `episodes "2"`, 3)
+}
@@ -0,0 +1,323 @@
+package httpclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PART_EXTENSION      = ".part"
+	PART_INFO_EXTENSION = ".part.json"
+	DOWNLOAD_ATTEMPTS   = 3
+	PROGRESS_INTERVAL   = 500 * time.Millisecond
+)
+
+/*
+	Sidecar saved next to a .part file, used to resume the download
+*/
+type partInfo struct {
+	URL    string `json:"url"`
+	ETag   string `json:"etag"`
+	Length int64  `json:"length"`
+}
+
+/*
+	Errors that make no sense to retry (e.g. 404)
+*/
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+/*
+	Downloads url into fullPath.
+	The data is written to fullPath.part and a small sidecar (fullPath.part.json)
+	keeps the url, ETag and length, so a failed attempt or a later run resumes
+	the transfer with a Range request instead of starting from zero.
+	The file is renamed to fullPath only once its size matches the expected length.
+	onProgress, when not nil, is called with the bytes on disk and the expected total.
+	When ctx is cancelled the transfer stops and the .part file is kept to be resumed
+*/
+func DownloadFile(ctx context.Context, client *http.Client, url string, fullPath string, onProgress func(done int64, total int64)) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var err error
+	for attempt := 1; attempt <= DOWNLOAD_ATTEMPTS; attempt++ {
+		if err = downloadAttempt(ctx, client, url, fullPath, onProgress); err == nil {
+			return nil
+		}
+
+		var permanent permanentError
+		if errors.As(err, &permanent) || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt < DOWNLOAD_ATTEMPTS {
+			fmt.Printf("⚠️ Download of %s interrupted, resuming (attempt %d/%d): \n\t- %s\n", fullPath, attempt+1, DOWNLOAD_ATTEMPTS, err)
+			if err := sleep(ctx, time.Duration(attempt) * 2 * time.Second); err != nil {
+				return err
+			}
+		}
+	}
+
+	return err
+}
+
+/*
+	Removes the .part file and its sidecar
+*/
+func RemovePartial(fullPath string) error {
+	if err := os.Remove(fullPath + PART_EXTENSION); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Remove(fullPath + PART_INFO_EXTENSION); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func downloadAttempt(ctx context.Context, client *http.Client, url string, fullPath string, onProgress func(done int64, total int64)) error {
+	partPath := fullPath + PART_EXTENSION
+	infoPath := fullPath + PART_INFO_EXTENSION
+
+	info   := readPartInfo(infoPath)
+	offset := int64(0)
+
+	if stat, err := os.Stat(partPath); err == nil && (info.URL == url || info.ETag != "") {
+		offset = stat.Size()
+	}
+
+	if offset > 0 && info.Length > 0 && offset == info.Length {
+		return completePart(partPath, infoPath, fullPath)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return permanentError{fmt.Errorf("error creating request: \n\t- %s", err)}
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if info.ETag != "" {
+			req.Header.Set("If-Range", info.ETag)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error getting download url: \n\t- %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		if err := checkContentType(resp.Header.Get("Content-Type")); err != nil {
+			return permanentError{err}
+		}
+	}
+
+	var outFile *os.File
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			_ = RemovePartial(fullPath)
+			return fmt.Errorf("invalid content range %q for offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+
+		if total > 0 {
+			info.Length = total
+		}
+
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			info.ETag = etag
+		}
+
+		outFile, err = os.OpenFile(partPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return permanentError{fmt.Errorf("error opening file: \n\t- %s", err)}
+		}
+
+	case http.StatusOK:
+		// the server ignored the range or the file changed, start from zero
+		offset = 0
+		info   = partInfo{
+			ETag:   resp.Header.Get("ETag"),
+			Length: resp.ContentLength,
+		}
+
+		outFile, err = os.Create(partPath)
+		if err != nil {
+			return permanentError{fmt.Errorf("error creating file: \n\t- %s", err)}
+		}
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		_ = RemovePartial(fullPath)
+		return fmt.Errorf("invalid status code: %s", resp.Status)
+
+	default:
+		statusErr := fmt.Errorf("invalid status code: %s", resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return permanentError{statusErr}
+		}
+		return statusErr
+	}
+
+	info.URL = url
+	if err := writePartInfo(infoPath, info); err != nil {
+		outFile.Close()
+		return permanentError{fmt.Errorf("error writing %s: \n\t- %s", infoPath, err)}
+	}
+
+	var writer io.Writer = outFile
+	if onProgress != nil {
+		writer = &progressWriter{
+			writer:     outFile,
+			done:       offset,
+			total:      info.Length,
+			onProgress: onProgress,
+		}
+	}
+
+	_, copyErr := io.Copy(writer, limitReader(ctx, resp.Body))
+	if err := outFile.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	if copyErr != nil {
+		return fmt.Errorf("error copying file: \n\t- %s", copyErr)
+	}
+
+	if info.Length > 0 {
+		stat, err := os.Stat(partPath)
+		if err != nil {
+			return fmt.Errorf("error reading %s: \n\t- %s", partPath, err)
+		}
+
+		if stat.Size() != info.Length {
+			return fmt.Errorf("incomplete download: %d of %d bytes", stat.Size(), info.Length)
+		}
+	}
+
+	if onProgress != nil {
+		stat, err := os.Stat(partPath)
+		if err == nil {
+			onProgress(stat.Size(), info.Length)
+		}
+	}
+
+	return completePart(partPath, infoPath, fullPath)
+}
+
+/*
+	Rejects the responses that can't be a video, e.g. the HTML error page
+	some hosts send with a 200 when a link expired
+*/
+func checkContentType(contentType string) error {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType        = strings.TrimSpace(mediaType)
+
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml") {
+		return fmt.Errorf("invalid content type %s, expected a video", mediaType)
+	}
+
+	return nil
+}
+
+/*
+	Writer that reports the written bytes at most once every PROGRESS_INTERVAL
+*/
+type progressWriter struct {
+	writer     io.Writer
+	done       int64
+	total      int64
+	lastReport time.Time
+	onProgress func(done int64, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.writer.Write(b)
+	p.done += int64(n)
+
+	if time.Since(p.lastReport) >= PROGRESS_INTERVAL {
+		p.lastReport = time.Now()
+		p.onProgress(p.done, p.total)
+	}
+
+	return n, err
+}
+
+func completePart(partPath string, infoPath string, fullPath string) error {
+	if err := os.Rename(partPath, fullPath); err != nil {
+		return permanentError{fmt.Errorf("error renaming %s: \n\t- %s", partPath, err)}
+	}
+
+	_ = os.Remove(infoPath)
+	return nil
+}
+
+func readPartInfo(infoPath string) partInfo {
+	var info partInfo
+
+	content, err := os.ReadFile(infoPath)
+	if err != nil {
+		return info
+	}
+
+	_ = json.Unmarshal(content, &info)
+	return info
+}
+
+func writePartInfo(infoPath string, info partInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(infoPath, content, 0644)
+}
+
+/*
+	Parses a "bytes start-end/total" header, total is -1 when unknown
+*/
+func parseContentRange(header string) (int64, int64, error) {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+
+	rangeAndTotal := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(rangeAndTotal) != 2 {
+		return 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+
+	bounds := strings.SplitN(rangeAndTotal[0], "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid content range %q", header)
+	}
+
+	total := int64(-1)
+	if rangeAndTotal[1] != "*" {
+		total, err = strconv.ParseInt(rangeAndTotal[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid content range %q", header)
+		}
+	}
+
+	return start, total, nil
+}
@@ -0,0 +1,88 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// the request or the connection timed out
+	ErrTimeout     = errors.New("request timed out")
+	// the server rejected the session (401, or 419 when the CSRF token expired)
+	ErrAuthExpired = errors.New("authentication expired")
+)
+
+/*
+	Returned when the server answers with a non 2xx status
+*/
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	Body       []byte
+
+	retryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: invalid status code %s", e.Method, e.URL, e.Status)
+}
+
+/*
+	Makes errors.Is(err, ErrAuthExpired) true for 401 and 419
+*/
+func (e *StatusError) Unwrap() error {
+	if isAuthStatus(e.StatusCode) {
+		return ErrAuthExpired
+	}
+
+	return nil
+}
+
+/*
+	Reports whether a new attempt of the same request can succeed
+*/
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode == http.StatusRequestTimeout  ||
+	       e.StatusCode == http.StatusTooManyRequests ||
+	       e.StatusCode >= 500
+}
+
+func isAuthStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == 419
+}
+
+/*
+	Wraps network timeouts with ErrTimeout, other errors are returned as they are
+*/
+func classifyError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %s", ErrTimeout, err)
+	}
+
+	return err
+}
+
+/*
+	Reports whether err is worth another attempt
+*/
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Retryable()
+	}
+
+	// network errors (timeouts, resets, DNS...) are transient
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, ErrTimeout)
+}
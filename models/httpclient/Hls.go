@@ -0,0 +1,560 @@
+package httpclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+)
+
+const (
+	HLS_DIR_EXTENSION       = ".hls"
+	// the MPEG-TS streams are saved with it in place of the extension of fullPath
+	HLS_TS_EXTENSION        = ".ts"
+	HLS_CONCURRENT_SEGMENTS = 4
+	HLS_BUFFER              = 64
+)
+
+/*
+	A variant stream of a master playlist
+*/
+type hlsRendition struct {
+	URL       string
+	Bandwidth int64
+	Width     int
+	Height    int
+}
+
+type hlsKey struct {
+	Method string
+	URI    string
+	IV     []byte // nil when derived from the media sequence number
+}
+
+type hlsSegment struct {
+	URL      string
+	Key      *hlsKey
+	Sequence uint64
+}
+
+/*
+	A master playlist has only renditions, a media playlist has only segments
+*/
+type hlsPlaylist struct {
+	Renditions []hlsRendition
+	Init       string // EXT-X-MAP, the fMP4 header written before the segments
+	Segments   []hlsSegment
+}
+
+/*
+	Returns the heights of the renditions of a master playlist,
+	empty when playlistURL is already a media playlist
+*/
+func HLSRenditions(ctx context.Context, client *http.Client, playlistURL string) ([]int, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	playlist, err := fetchPlaylist(ctx, client, playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	heights := make([]int, 0, len(playlist.Renditions))
+	for _, rendition := range playlist.Renditions {
+		heights = append(heights, rendition.Height)
+	}
+
+	return heights, nil
+}
+
+/*
+	Downloads the HLS stream of playlistURL into fullPath and returns the height of the rendition
+	and the path of the video.
+	When it's a master playlist the rendition with the given height is used, with the
+	highest bandwidth when height is 0 or not available.
+	The segments are downloaded in parallel by the "hls" sub group of the routine pool
+	into the fullPath.hls directory, so an interrupted download skips the ones already
+	there, AES-128 segments are decrypted and then everything is concatenated into fullPath.
+	Only fMP4 streams (with EXT-X-MAP) are MP4 files, the MPEG-TS ones are concatenated
+	into fullPath with the .ts extension.
+	onProgress, when not nil, is called with the bytes downloaded and the estimated total
+*/
+func DownloadHLS(ctx context.Context, client *http.Client, playlistURL string, height int, fullPath string, onProgress func(done int64, total int64)) (int, string, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	playlist, err := fetchPlaylist(ctx, client, playlistURL)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if len(playlist.Renditions) > 0 {
+		rendition := pickRendition(playlist.Renditions, height)
+		height     = rendition.Height
+
+		playlist, err = fetchPlaylist(ctx, client, rendition.URL)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	if len(playlist.Segments) == 0 {
+		return 0, "", fmt.Errorf("no segments found in %s", playlistURL)
+	}
+
+	segmentsDir := fullPath + HLS_DIR_EXTENSION
+	if err := os.MkdirAll(segmentsDir, os.ModePerm); err != nil {
+		return 0, "", fmt.Errorf("error creating directory: \n\t- %s", err)
+	}
+
+	files := make([]string, 0, len(playlist.Segments) + 1)
+	if playlist.Init != "" {
+		initFile := filepath.Join(segmentsDir, "init.mp4")
+		if _, err := downloadSegment(ctx, client, hlsSegment{URL: playlist.Init}, initFile, nil); err != nil {
+			return 0, "", err
+		}
+		files = append(files, initFile)
+	}
+
+	for i := range playlist.Segments {
+		files = append(files, filepath.Join(segmentsDir, fmt.Sprintf("%05d.ts", i)))
+	}
+
+	if err := downloadSegments(ctx, client, playlist.Segments, files[len(files) - len(playlist.Segments):], onProgress); err != nil {
+		return 0, "", err
+	}
+
+	videoPath := fullPath
+	if playlist.Init == "" {
+		videoPath = strings.TrimSuffix(fullPath, filepath.Ext(fullPath)) + HLS_TS_EXTENSION
+	}
+
+	return height, videoPath, concatSegments(files, videoPath, segmentsDir)
+}
+
+/*
+	Picks the rendition with the given height, or the highest bandwidth,
+	among the ones of that height if any, the resolution breaks the ties
+*/
+func pickRendition(renditions []hlsRendition, height int) hlsRendition {
+	candidates := []hlsRendition{}
+	for _, r := range renditions {
+		if height > 0 && r.Height == height {
+			candidates = append(candidates, r)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = renditions
+	}
+
+	best := candidates[0]
+	for _, r := range candidates[1:] {
+		if r.Bandwidth > best.Bandwidth || (r.Bandwidth == best.Bandwidth && r.Height > best.Height) {
+			best = r
+		}
+	}
+
+	return best
+}
+
+func fetchPlaylist(ctx context.Context, client *http.Client, playlistURL string) (hlsPlaylist, error) {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return hlsPlaylist{}, fmt.Errorf("invalid playlist url %s: \n\t- %s", playlistURL, err)
+	}
+
+	body, err := fetch(ctx, client, playlistURL)
+	if err != nil {
+		return hlsPlaylist{}, fmt.Errorf("error getting playlist %s: \n\t- %s", playlistURL, err)
+	}
+
+	return parsePlaylist(base, body)
+}
+
+/*
+	Parses a master or media playlist, the uris are resolved against base
+*/
+func parsePlaylist(base *url.URL, body []byte) (hlsPlaylist, error) {
+	var playlist hlsPlaylist
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return playlist, errors.New("invalid playlist: missing #EXTM3U")
+	}
+
+	var (
+		key       *hlsKey
+		rendition *hlsRendition
+		sequence  uint64
+		segment   bool
+	)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		tag, value, _ := strings.Cut(line, ":")
+
+		switch {
+		case tag == "#EXT-X-STREAM-INF":
+			attributes := parseAttributes(value)
+			rendition   = &hlsRendition{}
+			rendition.Bandwidth, _ = strconv.ParseInt(attributes["BANDWIDTH"], 10, 64)
+			if width, height, ok := strings.Cut(attributes["RESOLUTION"], "x"); ok {
+				rendition.Width, _  = strconv.Atoi(width)
+				rendition.Height, _ = strconv.Atoi(height)
+			}
+
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			sequence, _ = strconv.ParseUint(value, 10, 64)
+
+		case tag == "#EXT-X-KEY":
+			attributes := parseAttributes(value)
+			switch attributes["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				key = &hlsKey{Method: attributes["METHOD"], URI: resolve(base, attributes["URI"])}
+				if iv := attributes["IV"]; iv != "" {
+					decoded, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(decoded) != aes.BlockSize {
+						return playlist, fmt.Errorf("invalid key iv %s", iv)
+					}
+					key.IV = decoded
+				}
+			default:
+				return playlist, fmt.Errorf("unsupported encryption %s", attributes["METHOD"])
+			}
+
+		case tag == "#EXT-X-MAP":
+			playlist.Init = resolve(base, parseAttributes(value)["URI"])
+
+		case tag == "#EXT-X-BYTERANGE":
+			return playlist, errors.New("byte range segments are not supported")
+
+		case tag == "#EXTINF":
+			segment = true
+
+		case strings.HasPrefix(line, "#"):
+			// other tags don't change how the stream is downloaded
+
+		case rendition != nil:
+			rendition.URL = resolve(base, line)
+			playlist.Renditions = append(playlist.Renditions, *rendition)
+			rendition = nil
+
+		case segment:
+			playlist.Segments = append(playlist.Segments, hlsSegment{URL: resolve(base, line), Key: key, Sequence: sequence})
+			sequence++
+			segment = false
+		}
+	}
+
+	return playlist, scanner.Err()
+}
+
+/*
+	Parses an attribute list like BANDWIDTH=800000,CODECS="avc1.4d401f,mp4a.40.2"
+*/
+func parseAttributes(list string) map[string]string {
+	attributes := map[string]string{}
+
+	for len(list) > 0 {
+		name, rest, ok := strings.Cut(list, "=")
+		if !ok {
+			break
+		}
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			value = rest[1 : end+1]
+			rest  = rest[min(end+2, len(rest)):]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			rest = "," + rest
+		}
+
+		attributes[strings.TrimSpace(name)] = value
+		list = strings.TrimPrefix(rest, ",")
+	}
+
+	return attributes
+}
+
+func resolve(base *url.URL, ref string) string {
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+
+	return base.ResolveReference(parsed).String()
+}
+
+/*
+	Downloads the segments into files in parallel, stops at the first error
+*/
+func downloadSegments(ctx context.Context, client *http.Client, segments []hlsSegment, files []string, onProgress func(done int64, total int64)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var progressMu sync.Mutex
+	var doneBytes, doneSegments int64
+	var lastReport time.Time
+
+	report := func(size int64) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+
+		doneBytes += size
+		doneSegments++
+
+		// the total is unknown until the end, estimate it from the average segment
+		if onProgress != nil && (time.Since(lastReport) >= PROGRESS_INTERVAL || doneSegments == int64(len(segments))) {
+			lastReport = time.Now()
+			onProgress(doneBytes, doneBytes * int64(len(segments)) / doneSegments)
+		}
+	}
+
+	keys := &keyCache{keys: map[string][]byte{}}
+	pool := routinepoll.GetInstance().AddSubGroup("hls", HLS_BUFFER, HLS_CONCURRENT_SEGMENTS)
+
+	// buffered so the tasks never block on send after an early return
+	results := make(chan error, len(segments))
+	for i, segment := range segments {
+		file  := files[i]
+		added := pool.AddTask(func() {
+			if err := ctx.Err(); err != nil {
+				results <- err
+				return
+			}
+
+			size, err := downloadSegment(ctx, client, segment, file, keys)
+			if err == nil {
+				report(size)
+			}
+			results <- err
+		})
+
+		if !added {
+			results <- context.Canceled
+		}
+	}
+
+	for range segments {
+		select {
+		case err := <-results:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-pool.Context().Done():
+			return pool.Context().Err()
+		}
+	}
+
+	return nil
+}
+
+/*
+	Keys fetched once per uri and shared by the segments
+*/
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (c *keyCache) get(ctx context.Context, client *http.Client, uri string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[uri]; ok {
+		return key, nil
+	}
+
+	key, err := fetch(ctx, client, uri)
+	if err != nil {
+		return nil, fmt.Errorf("error getting key %s: \n\t- %s", uri, err)
+	}
+
+	if len(key) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid key %s: %d bytes", uri, len(key))
+	}
+
+	c.keys[uri] = key
+	return key, nil
+}
+
+/*
+	Downloads and decrypts a segment into file and returns its size, skipped when file already exists.
+	It's written aside and renamed so a file on disk is always complete
+*/
+func downloadSegment(ctx context.Context, client *http.Client, segment hlsSegment, file string, keys *keyCache) (int64, error) {
+	if stat, err := os.Stat(file); err == nil {
+		return stat.Size(), nil
+	}
+
+	data, err := fetch(ctx, client, segment.URL)
+	if err != nil {
+		return 0, fmt.Errorf("error getting segment %s: \n\t- %s", segment.URL, err)
+	}
+
+	if segment.Key != nil {
+		key, err := keys.get(ctx, client, segment.Key.URI)
+		if err != nil {
+			return 0, err
+		}
+
+		iv := segment.Key.IV
+		if iv == nil {
+			iv = make([]byte, aes.BlockSize)
+			binary.BigEndian.PutUint64(iv[8:], segment.Sequence)
+		}
+
+		if data, err = decryptSegment(data, key, iv); err != nil {
+			return 0, fmt.Errorf("error decrypting segment %s: \n\t- %s", segment.URL, err)
+		}
+	}
+
+	if err := os.WriteFile(file + ".tmp", data, 0644); err != nil {
+		return 0, fmt.Errorf("error writing %s: \n\t- %s", file, err)
+	}
+
+	if err := os.Rename(file + ".tmp", file); err != nil {
+		return 0, fmt.Errorf("error renaming %s: \n\t- %s", file, err)
+	}
+
+	return int64(len(data)), nil
+}
+
+/*
+	AES-128 CBC with PKCS7 padding
+*/
+func decryptSegment(data []byte, key []byte, iv []byte) ([]byte, error) {
+	if len(data) == 0 || len(data) % aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted size %d", len(data))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+
+	padding := int(data[len(data) - 1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(data) {
+		return nil, errors.New("invalid padding")
+	}
+
+	return data[:len(data) - padding], nil
+}
+
+/*
+	Writes the files one after the other into fullPath, through a .part file,
+	then removes the segments directory
+*/
+func concatSegments(files []string, fullPath string, segmentsDir string) error {
+	partPath := fullPath + PART_EXTENSION
+
+	out, err := os.Create(partPath)
+	if err != nil {
+		return fmt.Errorf("error creating file: \n\t- %s", err)
+	}
+
+	for _, file := range files {
+		in, err := os.Open(file)
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("error reading segment %s: \n\t- %s", file, err)
+		}
+
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("error writing %s: \n\t- %s", partPath, err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error writing %s: \n\t- %s", partPath, err)
+	}
+
+	if err := os.Rename(partPath, fullPath); err != nil {
+		return fmt.Errorf("error renaming %s: \n\t- %s", partPath, err)
+	}
+
+	_ = os.RemoveAll(segmentsDir)
+	return nil
+}
+
+/*
+	GET url and returns the body, retried like the downloads on transient errors
+*/
+func fetch(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	var body []byte
+	var err  error
+
+	for attempt := 1; attempt <= DOWNLOAD_ATTEMPTS; attempt++ {
+		if body, err = fetchOnce(ctx, client, url); err == nil {
+			return body, nil
+		}
+
+		if ctx.Err() != nil || (!isRetryable(err) && !errors.Is(err, io.ErrUnexpectedEOF)) {
+			return nil, err
+		}
+
+		if attempt < DOWNLOAD_ATTEMPTS {
+			if err := sleep(ctx, time.Duration(attempt) * time.Second); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return nil, err
+}
+
+func fetchOnce(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newStatusError(resp)
+	}
+
+	return io.ReadAll(limitReader(ctx, resp.Body))
+}
@@ -0,0 +1,361 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testKey = []byte("0123456789abcdef")
+	testIV  = []byte("fedcba9876543210")
+)
+
+/*
+	A fake HLS server: a master playlist with two 720p and one 360p renditions,
+	the 720p media playlist is encrypted with AES-128 and the 360p one is not.
+	The fmp4 media playlist has the same segments as the 360p one after its EXT-X-MAP
+*/
+type hlsServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	hits map[string]int
+
+	segments720 [][]byte
+	segments360 [][]byte
+}
+
+func newHLSServer(t *testing.T) *hlsServer {
+	s := &hlsServer{hits: map[string]int{}}
+	for i := range 4 {
+		s.segments720 = append(s.segments720, bytes.Repeat([]byte(fmt.Sprintf("720p segment %d;", i)), 10+i))
+	}
+	for i := range 2 {
+		s.segments360 = append(s.segments360, bytes.Repeat([]byte(fmt.Sprintf("360p segment %d;", i)), 5))
+	}
+
+	const sequence = 7
+
+	// the first two segments take the iv from the media sequence, the third has an
+	// explicit one and the last is not encrypted
+	files := map[string][]byte{
+		"/master.m3u8": []byte(strings.Join([]string{
+			"#EXTM3U",
+			`#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401f,mp4a.40.2"`,
+			"360/index.m3u8",
+			"#EXT-X-STREAM-INF:BANDWIDTH=1500000,RESOLUTION=1280x720",
+			"720-low/index.m3u8",
+			`#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"`,
+			"/720/index.m3u8",
+		}, "\n")),
+		"/720/index.m3u8": []byte(strings.Join([]string{
+			"#EXTM3U",
+			"#EXT-X-VERSION:3",
+			fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", sequence),
+			`#EXT-X-KEY:METHOD=AES-128,URI="../key.bin"`,
+			"#EXTINF:4.0,",
+			"0.ts",
+			"#EXTINF:4.0,",
+			"1.ts",
+			fmt.Sprintf(`#EXT-X-KEY:METHOD=AES-128,URI="/key.bin",IV=0x%s`, hex.EncodeToString(testIV)),
+			"#EXTINF:4.0,",
+			"2.ts",
+			"#EXT-X-KEY:METHOD=NONE",
+			"#EXTINF:4.0,",
+			"3.ts",
+			"#EXT-X-ENDLIST",
+		}, "\n")),
+		"/360/index.m3u8": []byte(strings.Join([]string{
+			"#EXTM3U",
+			"#EXTINF:4.0,",
+			"0.ts",
+			"#EXTINF:4.0,",
+			"1.ts",
+			"#EXT-X-ENDLIST",
+		}, "\n")),
+		"/fmp4/index.m3u8": []byte(strings.Join([]string{
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			`#EXT-X-MAP:URI="init.mp4"`,
+			"#EXTINF:4.0,",
+			"/360/0.ts",
+			"#EXTINF:4.0,",
+			"/360/1.ts",
+			"#EXT-X-ENDLIST",
+		}, "\n")),
+		"/fmp4/init.mp4": []byte("fmp4 init;"),
+		"/key.bin":       testKey,
+	}
+
+	for i, segment := range s.segments720 {
+		switch i {
+		case 0, 1:
+			iv := make([]byte, aes.BlockSize)
+			binary.BigEndian.PutUint64(iv[8:], uint64(sequence+i))
+			segment = encrypt(t, segment, iv)
+		case 2:
+			segment = encrypt(t, segment, testIV)
+		}
+		files[fmt.Sprintf("/720/%d.ts", i)] = segment
+	}
+
+	for i, segment := range s.segments360 {
+		files[fmt.Sprintf("/360/%d.ts", i)] = segment
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.hits[r.URL.Path]++
+		s.mu.Unlock()
+
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *hlsServer) hitsOf(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.hits[path]
+}
+
+/*
+	AES-128 CBC with PKCS7 padding, as the segments are served
+*/
+func encrypt(t *testing.T, data []byte, iv []byte) []byte {
+	block, err := aes.NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	padding   := aes.BlockSize - len(data)%aes.BlockSize
+	encrypted := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	return encrypted
+}
+
+func TestHLSRenditions(t *testing.T) {
+	server := newHLSServer(t)
+
+	heights, err := HLSRenditions(context.Background(), server.Client(), server.URL + "/master.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{360, 720, 720}; !reflect.DeepEqual(heights, want) {
+		t.Errorf("got heights %v, want %v", heights, want)
+	}
+
+	// a media playlist has no renditions
+	heights, err = HLSRenditions(context.Background(), server.Client(), server.URL + "/360/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(heights) != 0 {
+		t.Errorf("got heights %v for a media playlist", heights)
+	}
+}
+
+func TestPickRendition(t *testing.T) {
+	renditions := []hlsRendition{
+		{URL: "360", Bandwidth: 800000, Height: 360},
+		{URL: "720-low", Bandwidth: 1500000, Height: 720},
+		{URL: "720", Bandwidth: 2500000, Height: 720},
+		{URL: "1080", Bandwidth: 2500000, Height: 1080},
+	}
+
+	for _, test := range []struct {
+		height int
+		want   string
+	}{
+		{0, "1080"},
+		{360, "360"},
+		{720, "720"},
+		{480, "1080"},
+	} {
+		if got := pickRendition(renditions, test.height); got.URL != test.want {
+			t.Errorf("height %d: got %s, want %s", test.height, got.URL, test.want)
+		}
+	}
+}
+
+/*
+	Downloads the 720p rendition: the segments are decrypted with the iv of the
+	media sequence or the explicit one and concatenated in order
+*/
+func TestDownloadHLS(t *testing.T) {
+	server   := newHLSServer(t)
+	fullPath := filepath.Join(t.TempDir(), "Episode_1.mp4")
+
+	var lastDone, lastTotal int64
+	height, path, err := DownloadHLS(context.Background(), server.Client(), server.URL + "/master.m3u8", 720, fullPath, func(done int64, total int64) {
+		lastDone, lastTotal = done, total
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if height != 720 {
+		t.Errorf("got height %d, want 720", height)
+	}
+
+	// MPEG-TS segments, not an MP4
+	if want := filepath.Join(filepath.Dir(fullPath), "Episode_1.ts"); path != want {
+		t.Errorf("saved at %s, want %s", path, want)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := bytes.Join(server.segments720, nil); !bytes.Equal(content, want) {
+		t.Errorf("got content %q, want %q", content, want)
+	}
+
+	if lastDone != int64(len(content)) || lastTotal != lastDone {
+		t.Errorf("last progress %d/%d, want %d", lastDone, lastTotal, len(content))
+	}
+
+	if hits := server.hitsOf("/720-low/index.m3u8"); hits != 0 {
+		t.Errorf("the lower bandwidth 720p rendition was fetched %d times", hits)
+	}
+
+	// both key uris resolve to the same key, fetched once
+	if hits := server.hitsOf("/key.bin"); hits != 1 {
+		t.Errorf("the key was fetched %d times, want 1", hits)
+	}
+
+	for _, leftover := range []string{fullPath, fullPath + HLS_DIR_EXTENSION, path + PART_EXTENSION} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", leftover)
+		}
+	}
+}
+
+func TestDownloadHLSByHeight(t *testing.T) {
+	server   := newHLSServer(t)
+	fullPath := filepath.Join(t.TempDir(), "Episode_1.mp4")
+
+	height, path, err := DownloadHLS(context.Background(), server.Client(), server.URL + "/master.m3u8", 360, fullPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if height != 360 {
+		t.Errorf("got height %d, want 360", height)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := bytes.Join(server.segments360, nil); !bytes.Equal(content, want) {
+		t.Errorf("got content %q, want %q", content, want)
+	}
+
+	if hits := server.hitsOf("/key.bin"); hits != 0 {
+		t.Errorf("the key was fetched %d times for a clear stream", hits)
+	}
+}
+
+/*
+	The segments already in the .hls directory of an interrupted download are not fetched again
+*/
+func TestDownloadHLSResume(t *testing.T) {
+	server      := newHLSServer(t)
+	fullPath    := filepath.Join(t.TempDir(), "Episode_1.mp4")
+	segmentsDir := fullPath + HLS_DIR_EXTENSION
+
+	if err := os.MkdirAll(segmentsDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(segmentsDir, "00000.ts"), server.segments360[0], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, path, err := DownloadHLS(context.Background(), server.Client(), server.URL + "/360/index.m3u8", 0, fullPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hits := server.hitsOf("/360/0.ts"); hits != 0 {
+		t.Errorf("the downloaded segment was fetched %d times", hits)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := bytes.Join(server.segments360, nil); !bytes.Equal(content, want) {
+		t.Errorf("got content %q, want %q", content, want)
+	}
+}
+
+/*
+	An fMP4 stream is an MP4 file, saved at fullPath with its init section first
+*/
+func TestDownloadHLSFragmentedMP4(t *testing.T) {
+	server   := newHLSServer(t)
+	fullPath := filepath.Join(t.TempDir(), "Episode_1.mp4")
+
+	_, path, err := DownloadHLS(context.Background(), server.Client(), server.URL + "/fmp4/index.m3u8", 0, fullPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != fullPath {
+		t.Errorf("saved at %s, want %s", path, fullPath)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := append([]byte("fmp4 init;"), bytes.Join(server.segments360, nil)...); !bytes.Equal(content, want) {
+		t.Errorf("got content %q, want %q", content, want)
+	}
+}
+
+func TestParsePlaylistErrors(t *testing.T) {
+	base, _ := url.Parse("http://localhost/720/index.m3u8")
+
+	for name, body := range map[string]string{
+		"missing header": "#EXTINF:4.0,\n0.ts",
+		"invalid iv":     "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key.bin\",IV=0x1234\n#EXTINF:4.0,\n0.ts",
+		"sample aes":     "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"key.bin\"\n#EXTINF:4.0,\n0.ts",
+		"byte range":     "#EXTM3U\n#EXTINF:4.0,\n#EXT-X-BYTERANGE:1000@0\n0.ts",
+	} {
+		if _, err := parsePlaylist(base, []byte(body)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bytes that can be read at once after an idle period
+	RATE_BURST = 256 * 1024
+	// the largest read, so the waits stay short
+	RATE_CHUNK = 32 * 1024
+)
+
+var (
+	rateRe = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([kmg]?)(?:i?b)?(?:/s)?$`)
+
+	// shared by every transfer of the process
+	downloadLimiter = &rateLimiter{}
+
+	// the last invalid rate, to warn only once about it
+	invalidRate   string
+	invalidRateMu sync.Mutex
+)
+
+/*
+	Parses a rate like "5MB/s", "500KB/s", "1.5M" or "800000" in bytes per second,
+	the units are powers of 1024. 0 means unlimited
+*/
+func ParseRate(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+
+	match := rateRe.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf("invalid rate %s, use a value like 5MB/s", value)
+	}
+
+	rate, _ := strconv.ParseFloat(match[1], 64)
+	switch strings.ToLower(match[2]) {
+	case "k":
+		rate *= 1024
+	case "m":
+		rate *= 1024 * 1024
+	case "g":
+		rate *= 1024 * 1024 * 1024
+	}
+
+	return int64(rate), nil
+}
+
+/*
+	Returns MAX_DOWNLOAD_RATE from the environment in bytes per second, 0 (unlimited) when unset or invalid
+*/
+func MaxDownloadRate() int64 {
+	value     := os.Getenv("MAX_DOWNLOAD_RATE")
+	rate, err := ParseRate(value)
+	if err != nil {
+		invalidRateMu.Lock()
+		if invalidRate != value {
+			invalidRate = value
+			fmt.Printf("⚠️ Invalid MAX_DOWNLOAD_RATE, downloads are not limited: \n\t- %s\n", err)
+		}
+		invalidRateMu.Unlock()
+	}
+
+	return rate
+}
+
+/*
+	Token bucket shared by the concurrent transfers: a read takes its bytes
+	from the bucket and, when it goes below zero, waits for it to refill
+*/
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+
+	now      := time.Now()
+	l.tokens  = min(l.tokens + now.Sub(l.last).Seconds() * l.rate, RATE_BURST)
+	l.last    = now
+	l.tokens -= float64(n)
+
+	delay := time.Duration(0)
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	return sleep(ctx, delay)
+}
+
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = float64(rate)
+}
+
+/*
+	Reader limited by MAX_DOWNLOAD_RATE together with every other transfer
+*/
+type limitedReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func limitReader(ctx context.Context, reader io.Reader) io.Reader {
+	// read at every transfer, so a change of the configuration applies to the next one
+	downloadLimiter.setRate(MaxDownloadRate())
+
+	return &limitedReader{ctx: ctx, reader: reader}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > RATE_CHUNK {
+		p = p[:RATE_CHUNK]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		if waitErr := downloadLimiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
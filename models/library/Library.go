@@ -0,0 +1,396 @@
+package library
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+	filelock "github.com/IceWizard98/series_downloader/utils/fileLock"
+	videocheck "github.com/IceWizard98/series_downloader/utils/videoCheck"
+)
+
+const (
+	LIBRARY_FILE      = "/.library"
+	LIBRARY_LOCK_FILE = "/.library.lock"
+)
+
+/*
+	An episode on disk
+*/
+type Entry struct {
+	Provider     string    `json:"provider"`
+	SeriesID     string    `json:"series_id"`
+	SeriesName   string    `json:"series_name"`
+	SeriesSlug   string    `json:"series_slug"`
+	EpisodeID    uint      `json:"episode_id"`
+	Number       uint16    `json:"number"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	Checksum     string    `json:"sha256"`
+	Quality      string    `json:"quality,omitempty"`
+	DownloadedAt time.Time `json:"downloaded_at"`
+}
+
+/*
+	The episodes of a series on disk, sorted by number
+*/
+type SeriesEntry struct {
+	Provider   string   `json:"provider"`
+	SeriesID   string   `json:"series_id"`
+	SeriesName string   `json:"series_name"`
+	SeriesSlug string   `json:"series_slug"`
+	Episodes   []Entry  `json:"episodes"`
+	Gaps       []uint16 `json:"gaps"`
+	Size       int64    `json:"size"`
+}
+
+/*
+	Index of the episodes downloaded under a root dir, saved in rootDir/.library.
+	The entries are kept in memory and read again only when the file changes.
+	Every change reads, changes and writes the file holding rootDir/.library.lock,
+	so processes sharing the root dir (e.g. the daemon and a watch) don't lose
+	each other's entries
+*/
+type Library struct {
+	rootDir string
+	mu      sync.Mutex
+
+	// the entries of the file as it was when last read or written
+	entries []Entry
+	stat    os.FileInfo
+}
+
+var (
+	instances   = map[string]*Library{}
+	instancesMu sync.Mutex
+)
+
+func GetInstance(rootDir string) *Library {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+
+	if instance, ok := instances[rootDir]; ok {
+		return instance
+	}
+
+	instance := &Library{rootDir: rootDir}
+	instances[rootDir] = instance
+
+	return instance
+}
+
+/*
+	Adds or replaces the entry of an episode saved at path, reading its size and checksum
+*/
+func (l *Library) Add(provider string, series models.Series, episode models.Episode, path string, quality string) (Entry, error) {
+	size, checksum, modTime, err := fileChecksum(path)
+	if err != nil {
+		return Entry{}, fmt.Errorf("error reading %s: \n\t- %s", path, err)
+	}
+
+	entry := Entry{
+		Provider:     provider,
+		SeriesID:     series.ID,
+		SeriesName:   series.Name,
+		SeriesSlug:   series.Slug,
+		EpisodeID:    episode.ID,
+		Number:       episode.Number,
+		Path:         path,
+		Size:         size,
+		Checksum:     checksum,
+		Quality:      quality,
+		DownloadedAt: modTime,
+	}
+
+	return entry, l.change(func(entries []Entry) []Entry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.Path != path && !e.is(provider, series.ID, episode.Number) {
+				kept = append(kept, e)
+			}
+		}
+
+		return append(kept, entry)
+	})
+}
+
+/*
+	Removes the entries of the given paths
+*/
+func (l *Library) Remove(paths ...string) error {
+	removed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		removed[path] = true
+	}
+
+	return l.change(func(entries []Entry) []Entry {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !removed[e.Path] {
+				kept = append(kept, e)
+			}
+		}
+
+		return kept
+	})
+}
+
+/*
+	Returns the entry of an episode if its file is still on disk
+*/
+func (l *Library) Find(provider string, seriesID string, number uint16) (Entry, bool) {
+	entry, found := l.find(provider, seriesID, number)
+	if !found {
+		return Entry{}, false
+	}
+
+	if _, err := os.Stat(entry.Path); err != nil {
+		return Entry{}, false
+	}
+
+	return entry, true
+}
+
+func (l *Library) find(provider string, seriesID string, number uint16) (Entry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		fmt.Printf("⚠️ Error loading library: \n\t- %s\n", err)
+	}
+
+	for _, e := range entries {
+		if e.is(provider, seriesID, number) {
+			return e, true
+		}
+	}
+
+	return Entry{}, false
+}
+
+/*
+	Returns the entries of a series sorted by number, every series when seriesID is empty
+*/
+func (l *Library) Episodes(provider string, seriesID string) []Entry {
+	l.mu.Lock()
+	entries, err := l.load()
+	if err != nil {
+		fmt.Printf("⚠️ Error loading library: \n\t- %s\n", err)
+	}
+
+	episodes := []Entry{}
+	for _, e := range entries {
+		if seriesID == "" || (e.SeriesID == seriesID && (e.Provider == provider || provider == "")) {
+			episodes = append(episodes, e)
+		}
+	}
+	l.mu.Unlock()
+
+	sort.Slice(episodes, func(i, j int) bool { return episodes[i].Number < episodes[j].Number })
+	return episodes
+}
+
+/*
+	Groups the entries by series, with the missing numbers between the first
+	and the last episode on disk and the total size
+*/
+func (l *Library) Series() []SeriesEntry {
+	bySeries := map[string]*SeriesEntry{}
+	list     := []*SeriesEntry{}
+
+	for _, e := range l.Episodes("", "") {
+		key    := e.Provider + "/" + e.SeriesID
+		series := bySeries[key]
+		if series == nil {
+			series = &SeriesEntry{Provider: e.Provider, SeriesID: e.SeriesID, SeriesName: e.SeriesName, SeriesSlug: e.SeriesSlug, Gaps: []uint16{}}
+			bySeries[key] = series
+			list = append(list, series)
+		}
+
+		series.Episodes = append(series.Episodes, e)
+		series.Size    += e.Size
+	}
+
+	result := make([]SeriesEntry, 0, len(list))
+	for _, series := range list {
+		for i := 1; i < len(series.Episodes); i++ {
+			for n := series.Episodes[i-1].Number + 1; n < series.Episodes[i].Number; n++ {
+				series.Gaps = append(series.Gaps, n)
+			}
+		}
+		result = append(result, *series)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].SeriesName < result[j].SeriesName })
+	return result
+}
+
+/*
+	Returns a copy of every entry
+*/
+func (l *Library) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		fmt.Printf("⚠️ Error loading library: \n\t- %s\n", err)
+	}
+
+	return slices.Clone(entries)
+}
+
+/*
+	Checks that the file of the entry is still the complete video that was downloaded:
+	same size and a valid container, and with checksum the same sha256
+*/
+func (e Entry) Verify(checksum bool) error {
+	stat, err := os.Stat(e.Path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s is missing", e.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: \n\t- %s", e.Path, err)
+	}
+
+	if stat.Size() != e.Size {
+		return fmt.Errorf("%s is %d bytes, %d when downloaded", e.Path, stat.Size(), e.Size)
+	}
+
+	if err := videocheck.Verify(e.Path); err != nil {
+		return err
+	}
+
+	if !checksum || e.Checksum == "" {
+		return nil
+	}
+
+	_, sum, _, err := fileChecksum(e.Path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: \n\t- %s", e.Path, err)
+	}
+
+	if sum != e.Checksum {
+		return fmt.Errorf("%s changed since it was downloaded, sha256 %s instead of %s", e.Path, sum, e.Checksum)
+	}
+
+	return nil
+}
+
+func (e Entry) is(provider string, seriesID string, number uint16) bool {
+	return e.SeriesID == seriesID && e.Number == number && (e.Provider == provider || e.Provider == "")
+}
+
+/*
+	Applies change to a copy of the entries and writes them back.
+	The file lock keeps other processes from writing between load and save
+*/
+func (l *Library) change(change func(entries []Entry) []Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, err := filelock.Lock(l.rootDir + LIBRARY_LOCK_FILE)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return err
+	}
+
+	return l.save(change(slices.Clone(entries)))
+}
+
+/*
+	Returns the entries in memory, read again when another process changed the file.
+	l.mu must be held and the result must not be modified
+*/
+func (l *Library) load() ([]Entry, error) {
+	stat, err := os.Stat(l.rootDir + LIBRARY_FILE)
+	if os.IsNotExist(err) {
+		l.entries, l.stat = []Entry{}, nil
+		return l.entries, nil
+	}
+	if err != nil {
+		return []Entry{}, err
+	}
+
+	// every save renames a new file in place, so the same file with the same time
+	// and size was not written meanwhile
+	if l.entries != nil && l.stat != nil && os.SameFile(stat, l.stat) && stat.ModTime().Equal(l.stat.ModTime()) && stat.Size() == l.stat.Size() {
+		return l.entries, nil
+	}
+
+	content, err := os.ReadFile(l.rootDir + LIBRARY_FILE)
+	if err != nil {
+		return []Entry{}, err
+	}
+
+	entries := []Entry{}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return []Entry{}, err
+	}
+
+	l.entries, l.stat = entries, stat
+	return l.entries, nil
+}
+
+/*
+	The file is written aside and renamed so readers never see it half written,
+	then the entries in memory are replaced. l.mu must be held
+*/
+func (l *Library) save(entries []Entry) error {
+	content, _ := json.Marshal(entries)
+
+	if err := os.WriteFile(l.rootDir + LIBRARY_FILE + ".tmp", content, 0664); err != nil {
+		return err
+	}
+
+	if err := os.Rename(l.rootDir + LIBRARY_FILE + ".tmp", l.rootDir + LIBRARY_FILE); err != nil {
+		return err
+	}
+
+	// without the stat the next load reads the file again
+	l.entries = nil
+	if stat, err := os.Stat(l.rootDir + LIBRARY_FILE); err == nil {
+		l.entries, l.stat = entries, stat
+	}
+
+	return nil
+}
+
+/*
+	Returns size, sha256 and modification time of a file, the time it was downloaded
+	or, for the files indexed later, the best guess of it
+*/
+func fileChecksum(path string) (int64, string, time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), stat.ModTime(), nil
+}
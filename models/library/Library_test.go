@@ -0,0 +1,135 @@
+package library
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+)
+
+func writeEpisode(t *testing.T, dir string, number uint16) string {
+	path := filepath.Join(dir, fmt.Sprintf("%d.mp4", number))
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("episode %d", number)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+/*
+	The entries are kept in memory, a change made by another process to the file is read again
+*/
+func TestLibraryEntries(t *testing.T) {
+	rootDir := t.TempDir()
+	lib     := &Library{rootDir: rootDir}
+	series  := models.Series{ID: "1", Name: "Naruto", Slug: "naruto"}
+
+	if entries := lib.Entries(); len(entries) != 0 {
+		t.Fatalf("got %d entries in an empty library", len(entries))
+	}
+
+	var wg sync.WaitGroup
+	for n := uint16(1); n <= 10; n++ {
+		path := writeEpisode(t, rootDir, n)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := lib.Add("animeunity", series, models.Episode{ID: uint(n) * 10, Number: n}, path, "720p"); err != nil {
+				t.Error(err)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+			lib.Find("animeunity", series.ID, n)
+			lib.Episodes("animeunity", series.ID)
+		}()
+	}
+	wg.Wait()
+
+	episodes := lib.Episodes("animeunity", series.ID)
+	if len(episodes) != 10 {
+		t.Fatalf("got %d episodes, want 10", len(episodes))
+	}
+
+	for i, e := range episodes {
+		if e.Number != uint16(i+1) {
+			t.Errorf("episode %d at position %d", e.Number, i)
+		}
+	}
+
+	// the copy returned can be changed without touching the library
+	episodes[0].Number = 99
+	if entry, ok := lib.Find("animeunity", series.ID, 1); !ok || entry.EpisodeID != 10 {
+		t.Errorf("episode 1 not found after changing the returned copy")
+	}
+
+	if err := lib.Remove(episodes[1].Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := lib.Find("animeunity", series.ID, 2); ok {
+		t.Error("episode 2 found after Remove")
+	}
+
+	// another process adds an episode
+	path    := writeEpisode(t, rootDir, 11)
+	entries := append(lib.Entries(), Entry{Provider: "animeunity", SeriesID: series.ID, Number: 11, Path: path})
+	content, _ := json.Marshal(entries)
+	if err := os.WriteFile(rootDir + LIBRARY_FILE, content, 0664); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(rootDir + LIBRARY_FILE, future, future)
+
+	if _, ok := lib.Find("animeunity", series.ID, 11); !ok {
+		t.Error("episode 11 added by another process not found")
+	}
+
+	// a fresh library reads what was saved
+	if episodes := (&Library{rootDir: rootDir}).Episodes("", ""); len(episodes) != 10 {
+		t.Errorf("got %d episodes from the file, want 10", len(episodes))
+	}
+
+	// the file of an entry was deleted
+	os.Remove(path)
+	if _, ok := lib.Find("animeunity", series.ID, 11); ok {
+		t.Error("episode 11 found after its file was deleted")
+	}
+}
+
+/*
+	Two libraries on the same root dir, like two processes, add episodes at the
+	same time: none of them is lost
+*/
+func TestLibrarySharedFile(t *testing.T) {
+	rootDir := t.TempDir()
+	libs    := []*Library{{rootDir: rootDir}, {rootDir: rootDir}}
+	series  := models.Series{ID: "1", Name: "Naruto", Slug: "naruto"}
+
+	var wg sync.WaitGroup
+	for n := uint16(1); n <= 20; n++ {
+		path := writeEpisode(t, rootDir, n)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := libs[n%2].Add("animeunity", series, models.Episode{Number: n}, path, "720p"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, lib := range append(libs, &Library{rootDir: rootDir}) {
+		if episodes := lib.Episodes("animeunity", series.ID); len(episodes) != 20 {
+			t.Errorf("library %d has %d episodes, want 20", i, len(episodes))
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/httpclient"
+)
+
+const (
+	FORMAT_NFO  = "nfo"
+	FORMAT_JSON = "json"
+	FORMAT_ALL  = "all"
+
+	TVSHOW_NFO  = "tvshow.nfo"
+	SERIES_JSON = "series.json"
+	POSTER_FILE = "poster"
+)
+
+var (
+	// the last invalid format, to warn only once about it
+	invalidFormat   string
+	invalidFormatMu sync.Mutex
+)
+
+/*
+	Metadata of a series, saved in series.json
+*/
+type SeriesInfo struct {
+	Provider string   `json:"provider"`
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Slug     string   `json:"slug"`
+	Plot     string   `json:"plot,omitempty"`
+	Year     uint16   `json:"year,omitempty"`
+	Genres   []string `json:"genres,omitempty"`
+	ImageURL string   `json:"image_url,omitempty"`
+	Episodes uint     `json:"episodes"`
+}
+
+/*
+	Metadata of an episode, saved next to the video with the .json extension
+*/
+type EpisodeInfo struct {
+	Provider   string `json:"provider"`
+	SeriesID   string `json:"series_id"`
+	SeriesName string `json:"series_name"`
+	ID         uint   `json:"id"`
+	Number     uint16 `json:"number"`
+	File       string `json:"file"`
+}
+
+type uniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type tvShowNFO struct {
+	XMLName  xml.Name `xml:"tvshow"`
+	Title    string   `xml:"title"`
+	Plot     string   `xml:"plot,omitempty"`
+	Year     uint16   `xml:"year,omitempty"`
+	Genres   []string `xml:"genre"`
+	Thumb    string   `xml:"thumb,omitempty"`
+	UniqueID uniqueID `xml:"uniqueid"`
+}
+
+type episodeNFO struct {
+	XMLName   xml.Name `xml:"episodedetails"`
+	Title     string   `xml:"title"`
+	ShowTitle string   `xml:"showtitle"`
+	Season    int      `xml:"season"`
+	Episode   uint16   `xml:"episode"`
+	UniqueID  uniqueID `xml:"uniqueid"`
+}
+
+/*
+	Returns METADATA_FORMAT from the environment: nfo (Kodi/Jellyfin), json or all,
+	empty when unset, none or invalid and nothing is exported
+*/
+func Format() string {
+	format := strings.ToLower(strings.TrimSpace(os.Getenv("METADATA_FORMAT")))
+
+	switch format {
+	case FORMAT_NFO, FORMAT_JSON, FORMAT_ALL:
+		return format
+	case "", "none":
+		return ""
+	}
+
+	invalidFormatMu.Lock()
+	if invalidFormat != format {
+		invalidFormat = format
+		fmt.Printf("⚠️ Invalid METADATA_FORMAT %s, use nfo, json or all\n", format)
+	}
+	invalidFormatMu.Unlock()
+
+	return ""
+}
+
+/*
+	True when the series directory lacks the metadata files, written by WriteSeries.
+	False when the episodes are not in a directory of their series
+*/
+func MissingSeries(rootDir string, series models.Series, format string) bool {
+	seriesDir := models.SeriesDir(rootDir, series)
+	if format == "" || seriesDir == filepath.Clean(rootDir) {
+		return false
+	}
+
+	for _, file := range seriesFiles(format) {
+		if _, err := os.Stat(filepath.Join(seriesDir, file)); err != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Writes tvshow.nfo and/or series.json in the series directory and downloads the poster,
+	the files already there are kept
+*/
+func WriteSeries(ctx context.Context, rootDir string, provider string, series models.Series, format string) error {
+	seriesDir := models.SeriesDir(rootDir, series)
+	if format == "" || seriesDir == filepath.Clean(rootDir) {
+		return nil
+	}
+
+	if err := os.MkdirAll(seriesDir, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: \n\t- %s", err)
+	}
+
+	poster := ""
+	if series.ImageURL != "" {
+		poster = POSTER_FILE + posterExtension(series.ImageURL)
+		posterPath := filepath.Join(seriesDir, poster)
+
+		if _, err := os.Stat(posterPath); err != nil {
+			if err := httpclient.DownloadFile(ctx, http.DefaultClient, series.ImageURL, posterPath, nil); err != nil {
+				fmt.Printf("⚠️ Error downloading the poster of %s: \n\t- %s\n", series.Name, err)
+				poster = ""
+			}
+		}
+	}
+
+	if format == FORMAT_NFO || format == FORMAT_ALL {
+		nfo := tvShowNFO{
+			Title:    series.Name,
+			Plot:     series.Plot,
+			Year:     series.Year,
+			Genres:   series.Genres,
+			Thumb:    poster,
+			UniqueID: uniqueID{Type: provider, Default: true, Value: series.ID},
+		}
+
+		if err := writeNew(filepath.Join(seriesDir, TVSHOW_NFO), nfo, true); err != nil {
+			return err
+		}
+	}
+
+	if format == FORMAT_JSON || format == FORMAT_ALL {
+		info := SeriesInfo{
+			Provider: provider,
+			ID:       series.ID,
+			Name:     series.Name,
+			Slug:     series.Slug,
+			Plot:     series.Plot,
+			Year:     series.Year,
+			Genres:   series.Genres,
+			ImageURL: series.ImageURL,
+			Episodes: series.Episodes,
+		}
+
+		if err := writeNew(filepath.Join(seriesDir, SERIES_JSON), info, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+	Writes the .nfo and/or .json sidecar of the episode saved at videoPath
+*/
+func WriteEpisode(provider string, series models.Series, episode models.Episode, videoPath string, format string) error {
+	base := strings.TrimSuffix(videoPath, filepath.Ext(videoPath))
+
+	if format == FORMAT_NFO || format == FORMAT_ALL {
+		nfo := episodeNFO{
+			Title:     fmt.Sprintf("Episode %d", episode.Number),
+			ShowTitle: series.Name,
+			Season:    1,
+			Episode:   episode.Number,
+			UniqueID:  uniqueID{Type: provider, Default: true, Value: fmt.Sprintf("%d", episode.ID)},
+		}
+
+		if err := write(base + ".nfo", nfo, true); err != nil {
+			return err
+		}
+	}
+
+	if format == FORMAT_JSON || format == FORMAT_ALL {
+		info := EpisodeInfo{
+			Provider:   provider,
+			SeriesID:   series.ID,
+			SeriesName: series.Name,
+			ID:         episode.ID,
+			Number:     episode.Number,
+			File:       filepath.Base(videoPath),
+		}
+
+		if err := write(base + ".json", info, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func seriesFiles(format string) []string {
+	switch format {
+	case FORMAT_NFO:
+		return []string{TVSHOW_NFO}
+	case FORMAT_JSON:
+		return []string{SERIES_JSON}
+	}
+
+	return []string{TVSHOW_NFO, SERIES_JSON}
+}
+
+/*
+	The extension of the image in the url, .jpg when it has none
+*/
+func posterExtension(imageURL string) string {
+	ext := ".jpg"
+	if parsed, err := url.Parse(imageURL); err == nil {
+		if e := strings.ToLower(path.Ext(parsed.Path)); e == ".jpg" || e == ".jpeg" || e == ".png" || e == ".webp" {
+			ext = e
+		}
+	}
+
+	return ext
+}
+
+/*
+	Writes v only when the file doesn't exist, so the edits made in the media server are kept
+*/
+func writeNew(file string, v any, asXML bool) error {
+	if _, err := os.Stat(file); err == nil {
+		return nil
+	}
+
+	return write(file, v, asXML)
+}
+
+/*
+	Writes v as XML or JSON, aside and renamed so a reader never sees it half written
+*/
+func write(file string, v any, asXML bool) error {
+	var content []byte
+	var err     error
+
+	if asXML {
+		content, err = xml.MarshalIndent(v, "", "  ")
+		content      = append([]byte(xml.Header), content...)
+	} else {
+		content, err = json.MarshalIndent(v, "", "  ")
+	}
+
+	if err != nil {
+		return fmt.Errorf("error encoding %s: \n\t- %s", file, err)
+	}
+
+	if err := os.WriteFile(file + ".tmp", content, 0664); err != nil {
+		return fmt.Errorf("error writing %s: \n\t- %s", file, err)
+	}
+
+	return os.Rename(file + ".tmp", file)
+}
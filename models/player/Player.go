@@ -0,0 +1,245 @@
+package player
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skratchdot/open-golang/open"
+)
+
+const (
+	DEFAULT_WATCHED_THRESHOLD = 85
+	IPC_CONNECT_TIMEOUT       = 10 * time.Second
+	IPC_RETRY_INTERVAL        = 100 * time.Millisecond
+
+	PROPERTY_POSITION = 1
+	PROPERTY_DURATION = 2
+)
+
+var (
+	// the last invalid threshold, to warn only once about it
+	invalidThreshold   string
+	invalidThresholdMu sync.Mutex
+)
+
+/*
+	How an episode was played.
+	Tracked is false when the player can't tell the position, then Watched is always true
+	as there is no way to know. Ended is false when the player was only launched, with the
+	default application, and it's still running
+*/
+type Playback struct {
+	Position float64
+	Duration float64
+	Tracked  bool
+	Watched  bool
+	Ended    bool
+}
+
+/*
+	A message of the mpv JSON IPC, only the property changes and the end of the file are used
+*/
+type ipcEvent struct {
+	Event  string          `json:"event"`
+	ID     int             `json:"id"`
+	Data   json.RawMessage `json:"data"`
+	Reason string          `json:"reason"`
+}
+
+/*
+	Returns PLAYER from the environment split in the command and its arguments,
+	nil when unset and the default application is used
+*/
+func Command() []string {
+	return strings.Fields(os.Getenv("PLAYER"))
+}
+
+/*
+	Returns WATCHED_THRESHOLD from the environment: the percentage of an episode
+	to play before it's watched, DEFAULT_WATCHED_THRESHOLD when unset or invalid
+*/
+func WatchedThreshold() float64 {
+	value := strings.TrimSuffix(strings.TrimSpace(os.Getenv("WATCHED_THRESHOLD")), "%")
+	if value == "" {
+		return DEFAULT_WATCHED_THRESHOLD
+	}
+
+	threshold, err := strconv.ParseFloat(value, 64)
+	if err == nil && threshold > 0 && threshold <= 100 {
+		return threshold
+	}
+
+	invalidThresholdMu.Lock()
+	if invalidThreshold != value {
+		invalidThreshold = value
+		fmt.Printf("⚠️ Invalid WATCHED_THRESHOLD %s, use a percentage like 85\n", value)
+	}
+	invalidThresholdMu.Unlock()
+
+	return DEFAULT_WATCHED_THRESHOLD
+}
+
+/*
+	Plays the video at path with the PLAYER command, or the default application when unset.
+	mpv is followed through its JSON IPC socket, any other player until it exits
+*/
+func Play(ctx context.Context, path string) (Playback, error) {
+	command := Command()
+
+	if len(command) == 0 {
+		if err := open.Run(path); err != nil {
+			return Playback{}, err
+		}
+		return Playback{Watched: true}, nil
+	}
+
+	// mpv on Windows listens on a named pipe, not reachable without other dependencies
+	if isMPV(command[0]) && runtime.GOOS != "windows" {
+		return playMPV(ctx, command, path)
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], append(command[1:], path)...)
+	if err := cmd.Run(); err != nil {
+		return Playback{}, fmt.Errorf("error running %s: \n\t- %s", command[0], err)
+	}
+
+	return Playback{Watched: true, Ended: true}, nil
+}
+
+func isMPV(command string) bool {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(command)), ".exe")
+	return name == "mpv"
+}
+
+/*
+	Runs mpv with an IPC socket and follows the position until it exits.
+	When the socket can't be reached the episode is handled as with any other player
+*/
+func playMPV(ctx context.Context, command []string, path string) (Playback, error) {
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("series_downloader-mpv-%d.sock", os.Getpid()))
+	_ = os.Remove(socket)
+	defer os.Remove(socket)
+
+	args := append(command[1:], "--input-ipc-server=" + socket, path)
+	cmd  := exec.CommandContext(ctx, command[0], args...)
+	if err := cmd.Start(); err != nil {
+		return Playback{}, fmt.Errorf("error running %s: \n\t- %s", command[0], err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	conn, err := dialIPC(socket, exited)
+	if err != nil {
+		if exitErr := <-exited; exitErr != nil {
+			return Playback{}, fmt.Errorf("error running %s: \n\t- %s", command[0], exitErr)
+		}
+
+		fmt.Printf("⚠️ Couldn't follow the playback of %s, marking it as watched: \n\t- %s\n", path, err)
+		return Playback{Watched: true, Ended: true}, nil
+	}
+
+	playback := Playback{Tracked: true, Ended: true}
+	followed := make(chan struct{})
+	go func() {
+		defer close(followed)
+		follow(conn, &playback)
+	}()
+
+	err = <-exited
+	// mpv closes the socket when it quits, but a child process could keep it open
+	conn.Close()
+	<-followed
+
+	if err != nil && playback.Position == 0 {
+		return Playback{}, fmt.Errorf("error running %s: \n\t- %s", command[0], err)
+	}
+
+	if playback.Duration > 0 && playback.Position / playback.Duration * 100 >= WatchedThreshold() {
+		playback.Watched = true
+	}
+
+	return playback, nil
+}
+
+/*
+	Connects to the socket of mpv, retrying while mpv starts
+*/
+func dialIPC(socket string, exited chan error) (net.Conn, error) {
+	deadline := time.Now().Add(IPC_CONNECT_TIMEOUT)
+
+	for {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			return conn, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+
+		select {
+		case exitErr := <-exited:
+			// let the caller read how it exited
+			exited <- exitErr
+			return nil, fmt.Errorf("the player exited before opening %s", socket)
+		case <-time.After(IPC_RETRY_INTERVAL):
+		}
+	}
+}
+
+/*
+	Observes position and duration and records them in playback until the socket is closed.
+	The end of the file counts as the whole episode played
+*/
+func follow(conn net.Conn, playback *Playback) {
+	for _, property := range []struct {
+		id   int
+		name string
+	}{{PROPERTY_POSITION, "time-pos"}, {PROPERTY_DURATION, "duration"}} {
+		request := fmt.Sprintf(`{"command": ["observe_property", %d, "%s"]}` + "\n", property.id, property.name)
+		if _, err := conn.Write([]byte(request)); err != nil {
+			return
+		}
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var event ipcEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+
+		switch event.Event {
+		case "property-change":
+			// the properties are null while nothing is loaded
+			var value *float64
+			if err := json.Unmarshal(event.Data, &value); err != nil || value == nil {
+				continue
+			}
+
+			switch event.ID {
+			case PROPERTY_POSITION:
+				playback.Position = *value
+			case PROPERTY_DURATION:
+				playback.Duration = *value
+			}
+
+		case "end-file":
+			if event.Reason == "eof" && playback.Duration > 0 {
+				playback.Position = playback.Duration
+			}
+		}
+	}
+}
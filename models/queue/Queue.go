@@ -0,0 +1,556 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/hooks"
+	"github.com/IceWizard98/series_downloader/models/library"
+	filelock "github.com/IceWizard98/series_downloader/utils/fileLock"
+	"github.com/IceWizard98/series_downloader/utils/iceRoutinePool"
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+)
+
+type State string
+
+const (
+	STATE_PENDING   State = "pending"
+	STATE_RUNNING   State = "running"
+	STATE_DONE      State = "done"
+	STATE_FAILED    State = "failed"
+	STATE_CANCELLED State = "cancelled"
+
+	QUEUE_BUFFER    = 256
+	QUEUE_FILE      = "/.queue"
+	QUEUE_LOCK_FILE = "/.queue.lock"
+)
+
+var ErrInUse = errors.New("the download queue is used by another process")
+
+type Job struct {
+	ID         uint64         `json:"id"`
+	Provider   string         `json:"provider"`
+	Series     models.Series  `json:"series"`
+	Episode    models.Episode `json:"episode"`
+	State      State          `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	Downloaded int64          `json:"downloaded"`
+	Total      int64          `json:"total"`
+	Speed      float64        `json:"speed"`
+	ETA        float64        `json:"eta_seconds"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+/*
+	Download queue: every enqueued episode becomes a job executed by the "queue"
+	sub group of the routine pool.
+	The jobs are saved in rootDir/.queue at every change of state, so the ones
+	left pending or running by a killed process are found by the next one.
+	Only one process at a time owns the queue of a root dir, it holds
+	rootDir/.queue.lock until it exits: the file is never written by two processes
+	and a job is never downloaded twice into the same partial file.
+	With a schedule the jobs wait for a window to start, and the running ones are
+	paused when it closes and resumed by the next one
+*/
+type Queue struct {
+	rootDir  string
+	lock     *filelock.FileLock
+	pool     *iceRoutinePool.IceRoutinePool
+	schedule Schedule
+
+	// optional, set them before Enqueue or Resume
+	OnProgress models.ProgressFunc
+	OnFinish   func(job Job)
+
+	mu      sync.Mutex
+	jobs    []*Job
+	nextID  uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+/*
+	Loads the queue saved in rootDir, the unfinished jobs are not started until Resume.
+	Returns ErrInUse when another process owns the queue of rootDir
+*/
+func New(rootDir string, concurrentJobs uint) (*Queue, error) {
+	if err := os.MkdirAll(rootDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	lock, err := filelock.TryLock(rootDir + QUEUE_LOCK_FILE)
+	if errors.Is(err, filelock.ErrLocked) {
+		return nil, fmt.Errorf("%w (%s), wait for it to finish or stop it", ErrInUse, rootDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		rootDir:  rootDir,
+		lock:     lock,
+		pool:     routinepoll.GetInstance().AddSubGroup("queue", QUEUE_BUFFER, concurrentJobs),
+		schedule: DownloadSchedule(),
+		cancels:  make(map[uint64]context.CancelFunc),
+	}
+
+	if err := q.load(); err != nil {
+		fmt.Printf("⚠️ Error loading download queue: \n\t- %s\n", err)
+	}
+
+	return q, nil
+}
+
+/*
+	Releases the queue to other processes, after Wait.
+	A process that exits releases it anyway
+*/
+func (q *Queue) Close() error {
+	return q.lock.Unlock()
+}
+
+/*
+	Starts the jobs left pending or running by a previous run, returns how many.
+	A job already started is skipped by run, so calling it twice is harmless
+*/
+func (q *Queue) Resume() int {
+	q.mu.Lock()
+	ids := []uint64{}
+	for _, job := range q.jobs {
+		if job.State == STATE_PENDING {
+			ids = append(ids, job.ID)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, id := range ids {
+		q.start(id)
+	}
+
+	return len(ids)
+}
+
+/*
+	Adds an episode to the queue.
+	If the same episode is already pending or running the existing job is returned
+*/
+func (q *Queue) Enqueue(provider string, series models.Series, episode models.Episode) Job {
+	q.mu.Lock()
+
+	jobs := q.jobs[:0]
+	for _, job := range q.jobs {
+		if job.Provider != provider || job.Series.ID != series.ID || job.Episode.Number != episode.Number {
+			jobs = append(jobs, job)
+			continue
+		}
+
+		if job.State == STATE_PENDING || job.State == STATE_RUNNING {
+			existing := *job
+			q.mu.Unlock()
+			return existing
+		}
+		// a finished job of the same episode is replaced, so the file doesn't grow forever
+	}
+	q.jobs = jobs
+
+	q.nextID++
+	now := time.Now()
+	job := &Job{
+		ID:        q.nextID,
+		Provider:  provider,
+		Series:    series,
+		Episode:   episode,
+		State:     STATE_PENDING,
+		Total:     -1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	q.jobs = append(q.jobs, job)
+	queued := *job
+	q.save()
+	q.mu.Unlock()
+
+	q.start(job.ID)
+
+	return queued
+}
+
+/*
+	Sets a failed or cancelled job back to pending and starts it
+*/
+func (q *Queue) Retry(id uint64) error {
+	q.mu.Lock()
+
+	job := q.find(id)
+	if job == nil {
+		q.mu.Unlock()
+		return fmt.Errorf("job %d not found", id)
+	}
+
+	if job.State != STATE_FAILED && job.State != STATE_CANCELLED {
+		q.mu.Unlock()
+		return fmt.Errorf("job %d is %s and can't be retried", id, job.State)
+	}
+
+	job.State     = STATE_PENDING
+	job.Error     = ""
+	job.UpdatedAt = time.Now()
+	q.save()
+	q.mu.Unlock()
+
+	q.start(id)
+	return nil
+}
+
+/*
+	Removes a job that is not running from the queue
+*/
+func (q *Queue) Drop(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, job := range q.jobs {
+		if job.ID != id {
+			continue
+		}
+
+		if job.State == STATE_RUNNING {
+			return fmt.Errorf("job %d is running, cancel it first", id)
+		}
+
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+		q.save()
+		return nil
+	}
+
+	return fmt.Errorf("job %d not found", id)
+}
+
+/*
+	Returns a copy of every job, in insertion order
+*/
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	return jobs
+}
+
+func (q *Queue) Get(id uint64) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.find(id)
+	if job == nil {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+/*
+	Cancels a pending or running job, a running download stops keeping its partial file
+*/
+func (q *Queue) Cancel(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job := q.find(id)
+	if job == nil {
+		return fmt.Errorf("job %d not found", id)
+	}
+
+	if job.State == STATE_RUNNING {
+		// run marks it cancelled once the download returns
+		q.cancels[id]()
+		return nil
+	}
+
+	if job.State != STATE_PENDING {
+		return fmt.Errorf("job %d is %s and can't be cancelled", id, job.State)
+	}
+
+	job.State     = STATE_CANCELLED
+	job.UpdatedAt = time.Now()
+	q.save()
+	return nil
+}
+
+/*
+	Waits for every queued job to complete
+*/
+func (q *Queue) Wait() {
+	q.pool.Wait()
+}
+
+func (q *Queue) find(id uint64) *Job {
+	for _, job := range q.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+
+	return nil
+}
+
+/*
+	Applies change to a job, the queue is saved only when its state changes
+	to not rewrite the file at every progress update
+*/
+func (q *Queue) update(id uint64, change func(job *Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job := q.find(id); job != nil {
+		state := job.State
+		change(job)
+		job.UpdatedAt = time.Now()
+
+		if job.State != state {
+			q.save()
+		}
+	}
+}
+
+/*
+	Reads the jobs saved in rootDir, the ones found running were interrupted
+	(their process no longer holds the lock) and go back to pending
+*/
+func (q *Queue) load() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jsonQueue, err := os.ReadFile(q.rootDir + QUEUE_FILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var jobs []*Job
+	if err := json.Unmarshal(jsonQueue, &jobs); err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.State == STATE_RUNNING {
+			job.State = STATE_PENDING
+		}
+
+		q.nextID = max(q.nextID, job.ID)
+	}
+
+	q.jobs = jobs
+	return nil
+}
+
+/*
+	Writes the jobs to disk, q.mu must be held.
+	The file is written aside and renamed so a crash never leaves it half written
+*/
+func (q *Queue) save() {
+	jsonQueue, _ := json.Marshal(q.jobs)
+
+	err := os.MkdirAll(q.rootDir, os.ModePerm)
+	if err == nil {
+		err = os.WriteFile(q.rootDir + QUEUE_FILE + ".tmp", jsonQueue, 0664)
+	}
+	if err == nil {
+		err = os.Rename(q.rootDir + QUEUE_FILE + ".tmp", q.rootDir + QUEUE_FILE)
+	}
+
+	if err != nil {
+		fmt.Printf("⚠️ Error saving download queue: \n\t- %s\n", err)
+	}
+}
+
+func (q *Queue) start(id uint64) {
+	q.pool.AddTask(func() {
+		q.run(id)
+	})
+}
+
+/*
+	Runs a job, again at the next window when it's paused by the end of the current one
+*/
+func (q *Queue) run(id uint64) {
+	for q.waitWindow(id) {
+		if paused := q.runOnce(id); !paused {
+			return
+		}
+	}
+}
+
+/*
+	Waits until a window of the schedule is open, false when the job is no longer
+	pending (cancelled or dropped meanwhile) or the pool is stopping
+*/
+func (q *Queue) waitWindow(id uint64) bool {
+	announced := false
+
+	for {
+		job, ok := q.Get(id)
+		if !ok || job.State != STATE_PENDING {
+			return false
+		}
+
+		wait := q.schedule.Until(time.Now())
+		if wait <= 0 {
+			return true
+		}
+
+		if !announced {
+			announced = true
+			fmt.Printf("⏸️ %s episode %d waits for the download window (%s), starting in %s\n", job.Series.Name, job.Episode.Number, q.schedule, wait.Round(time.Minute))
+		}
+
+		timer := time.NewTimer(min(wait, WINDOW_CHECK_INTERVAL))
+		select {
+		case <-q.pool.Context().Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+/*
+	Downloads a pending job, true when it was paused by the end of the window
+*/
+func (q *Queue) runOnce(id uint64) (paused bool) {
+	q.mu.Lock()
+	job := q.find(id)
+	if job == nil || job.State != STATE_PENDING {
+		q.mu.Unlock()
+		return false
+	}
+
+	ctx, cancel  := context.WithCancel(q.pool.Context())
+	defer cancel()
+
+	// the transfer stops when the window closes, the partial file is resumed in the next one
+	if end, ok := q.schedule.End(time.Now()); ok {
+		var cancelWindow context.CancelFunc
+		ctx, cancelWindow = context.WithDeadline(ctx, end)
+		defer cancelWindow()
+	}
+
+	job.State     = STATE_RUNNING
+	job.UpdatedAt = time.Now()
+	toRun        := *job
+	q.cancels[id] = cancel
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		delete(q.cancels, id)
+		q.mu.Unlock()
+	}()
+
+	provider, err := models.GetProvider(toRun.Provider)
+	if provider == nil {
+		q.update(id, func(job *Job) {
+			job.State = STATE_FAILED
+			job.Error = err.Error()
+		})
+		q.finish(id)
+		return false
+	}
+
+	fmt.Printf("⬇️ Downloading %s episode %d\n", toRun.Series.Name, toRun.Episode.Number)
+
+	defer func() {
+		if !paused {
+			q.finish(id)
+		}
+	}()
+
+	// the hooks are for the new files, not for the episodes already on disk
+	lib        := library.GetInstance(q.rootDir)
+	_, existed := lib.Find(toRun.Provider, toRun.Series.ID, toRun.Episode.Number)
+
+	path, err := provider.DownloadEpisode(ctx, toRun.Series, toRun.Episode, q.rootDir, func(progress models.Progress) {
+		if q.OnProgress != nil {
+			q.OnProgress(progress)
+		}
+
+		q.update(id, func(job *Job) {
+			job.Downloaded = progress.Done
+			job.Total      = progress.Total
+			job.Speed      = progress.Speed
+			job.ETA        = progress.ETA.Seconds()
+		})
+	})
+
+	// the provider errors are formatted, the contexts tell if it was cancelled.
+	// When the whole pool is stopping the job stays pending for the next run
+	if err != nil && q.pool.Context().Err() != nil {
+		q.update(id, func(job *Job) {
+			job.State = STATE_PENDING
+		})
+		return false
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		fmt.Printf("⏸️ Download window closed, %s episode %d paused\n", toRun.Series.Name, toRun.Episode.Number)
+		q.update(id, func(job *Job) {
+			job.State = STATE_PENDING
+		})
+		return true
+	}
+
+	if err != nil && ctx.Err() != nil {
+		fmt.Printf("❌ Download cancelled: %s %d\n", toRun.Series.Name, toRun.Episode.Number)
+		q.update(id, func(job *Job) {
+			job.State = STATE_CANCELLED
+		})
+		return false
+	}
+
+	if err != nil {
+		fmt.Printf("⚠️ Error downloading %s episode %d: \n\t- %s\n", toRun.Series.Name, toRun.Episode.Number, err)
+		q.update(id, func(job *Job) {
+			job.State = STATE_FAILED
+			job.Error = err.Error()
+		})
+		hooks.Failed(toRun.Provider, toRun.Series, toRun.Episode, err)
+		return false
+	}
+
+	fmt.Printf("✅ Episode downloaded: %s %d\n", toRun.Series.Name, toRun.Episode.Number)
+	q.update(id, func(job *Job) {
+		job.State = STATE_DONE
+		job.Path  = path
+		job.Error = ""
+	})
+
+	if !existed {
+		entry, _ := lib.Find(toRun.Provider, toRun.Series.ID, toRun.Episode.Number)
+		hooks.Downloaded(toRun.Provider, toRun.Series, toRun.Episode, path, entry.Quality)
+	}
+	return false
+}
+
+func (q *Queue) finish(id uint64) {
+	if q.OnFinish == nil {
+		return
+	}
+
+	if job, ok := q.Get(id); ok {
+		q.OnFinish(job)
+	}
+}
@@ -0,0 +1,46 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/IceWizard98/series_downloader/models"
+)
+
+/*
+	Only one process owns the queue of a root dir, the job left running by the
+	previous owner is pending for the next one
+*/
+func TestQueueOwner(t *testing.T) {
+	rootDir := t.TempDir()
+
+	jobs, _ := json.Marshal([]Job{{ID: 7, Provider: "animeunity", Series: models.Series{ID: "1"}, Episode: models.Episode{Number: 1}, State: STATE_RUNNING}})
+	if err := os.WriteFile(rootDir + QUEUE_FILE, jobs, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	owner, err := New(rootDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(rootDir, 1); !errors.Is(err, ErrInUse) {
+		t.Fatalf("got %v opening a queue already owned, want ErrInUse", err)
+	}
+
+	if err := owner.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := New(rootDir, 1)
+	if err != nil {
+		t.Fatalf("error opening the queue released by its owner: %s", err)
+	}
+	defer next.Close()
+
+	if job, ok := next.Get(7); !ok || job.State != STATE_PENDING {
+		t.Errorf("got job %+v, want it pending", job)
+	}
+}
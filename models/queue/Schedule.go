@@ -0,0 +1,185 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often a job waiting for its window checks if it was cancelled
+	WINDOW_CHECK_INTERVAL = time.Minute
+)
+
+var (
+	// the last invalid schedule, to warn only once about it
+	invalidSchedule   string
+	invalidScheduleMu sync.Mutex
+)
+
+/*
+	A time of the day when the jobs may run, from Start to End as offsets from midnight.
+	When End is before Start the window spans midnight, e.g. 22:00-06:00
+*/
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+/*
+	The windows when the jobs may run, always when empty
+*/
+type Schedule []Window
+
+/*
+	Parses comma separated windows like "01:00-07:00, 13:00-14:30"
+*/
+func ParseSchedule(value string) (Schedule, error) {
+	schedule := Schedule{}
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		start, end, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %s, use a range like 01:00-07:00", part)
+		}
+
+		window := Window{}
+		var err error
+		if window.Start, err = parseTimeOfDay(start); err != nil {
+			return nil, err
+		}
+		if window.End, err = parseTimeOfDay(end); err != nil {
+			return nil, err
+		}
+
+		if window.Start == window.End {
+			return nil, fmt.Errorf("invalid window %s, it starts when it ends", part)
+		}
+
+		schedule = append(schedule, window)
+	}
+
+	return schedule, nil
+}
+
+/*
+	Returns DOWNLOAD_WINDOWS from the environment, no limit when unset or invalid
+*/
+func DownloadSchedule() Schedule {
+	value         := os.Getenv("DOWNLOAD_WINDOWS")
+	schedule, err := ParseSchedule(value)
+	if err != nil {
+		invalidScheduleMu.Lock()
+		if invalidSchedule != value {
+			invalidSchedule = value
+			fmt.Printf("⚠️ Invalid DOWNLOAD_WINDOWS, downloads run at any time: \n\t- %s\n", err)
+		}
+		invalidScheduleMu.Unlock()
+
+		return nil
+	}
+
+	return schedule
+}
+
+/*
+	Returns how long until a window opens, 0 when one is open at now
+*/
+func (s Schedule) Until(now time.Time) time.Duration {
+	if len(s) == 0 {
+		return 0
+	}
+
+	offset := sinceMidnight(now)
+	wait   := 24 * time.Hour
+
+	for _, w := range s {
+		if w.contains(offset) {
+			return 0
+		}
+		wait = min(wait, (w.Start - offset + 24 * time.Hour) % (24 * time.Hour))
+	}
+
+	return wait
+}
+
+/*
+	Returns when the windows open at now close, false when there is no schedule or none is open.
+	Windows that overlap or follow each other count as one
+*/
+func (s Schedule) End(now time.Time) (time.Time, bool) {
+	if len(s) == 0 || s.Until(now) > 0 {
+		return time.Time{}, false
+	}
+
+	end := now
+	for range len(s) {
+		offset := sinceMidnight(end)
+
+		latest := time.Duration(0)
+		for _, w := range s {
+			if !w.contains(offset) {
+				continue
+			}
+
+			left := (w.End - offset + 24 * time.Hour) % (24 * time.Hour)
+			latest = max(latest, left)
+		}
+
+		if latest == 0 {
+			break
+		}
+		end = end.Add(latest)
+	}
+
+	return end, true
+}
+
+func (s Schedule) String() string {
+	windows := make([]string, 0, len(s))
+	for _, w := range s {
+		windows = append(windows, fmt.Sprintf("%s-%s", formatTimeOfDay(w.Start), formatTimeOfDay(w.End)))
+	}
+
+	return strings.Join(windows, ", ")
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+
+	return offset >= w.Start || offset < w.End
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	// 24:00 is the end of the day
+	if value == "24:00" {
+		return 0, nil
+	}
+
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, use HH:MM", value)
+	}
+
+	return time.Duration(t.Hour()) * time.Hour + time.Duration(t.Minute()) * time.Minute, nil
+}
+
+func formatTimeOfDay(offset time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(offset.Hours()), int(offset.Minutes()) % 60)
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return t.Sub(midnight)
+}
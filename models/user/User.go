@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/IceWizard98/series_downloader/models"
 	bloomfilter "github.com/IceWizard98/series_downloader/utils/bloomFilter"
@@ -12,29 +16,174 @@ import (
 	"github.com/joho/godotenv"
 )
 
-var instance *user
+var (
+	instance   *user
+	instanceMu sync.Mutex
+)
 
+/*
+	The user profile, its methods are safe for concurrent use
+*/
 type user struct {
 	Name    string
 	RootDir string
+	EnvFile string
+
+	mu      sync.Mutex
 	history []userHistory
 }
 
 type userHistory struct {
-  Provider          string `json:"provider"`
-  SeriesID          string `json:"series_id"`
-	SeriesName        string `json:"series_name"`
-	SeriesSlug        string `json:"series_slug"`
-	SeriesTotEpisodes uint16 `json:"series_tot_episodes"`
-  EpisodeID         uint   `json:"episode_id"`
-	EpisodeNumber     uint16 `json:"episode_number"`
+  Provider          string           `json:"provider"`
+  SeriesID          string           `json:"series_id"`
+	SeriesName        string           `json:"series_name"`
+	SeriesSlug        string           `json:"series_slug"`
+	SeriesTotEpisodes uint16           `json:"series_tot_episodes"`
+  EpisodeID         uint             `json:"episode_id"`
+	EpisodeNumber     uint16           `json:"episode_number"`
+	Watched           []watchedEpisode `json:"watched"`
+}
+
+/*
+	An episode marked as watched, WatchedAt is zero for the episodes
+	migrated from a history that only had the last episode
+*/
+type watchedEpisode struct {
+	Number    uint16    `json:"number"`
+	ID        uint      `json:"id,omitempty"`
+	WatchedAt time.Time `json:"watched_at"`
 }
 
 const (
 	HISTORY_FILE = "/.history"
 )
 
+/*
+	Returns the series of an history entry
+*/
+func (h userHistory) Series() models.Series {
+	return models.Series{
+		ID:       h.SeriesID,
+		Name:     h.SeriesName,
+		Slug:     h.SeriesSlug,
+		Episodes: uint(h.SeriesTotEpisodes),
+	}
+}
+
+/*
+	True when the episode is marked as watched
+*/
+func (h userHistory) IsWatched(number uint16) bool {
+	_, found := h.find(number)
+	return found
+}
+
+/*
+	Returns the numbers of the watched episodes, sorted
+*/
+func (h userHistory) WatchedNumbers() []uint16 {
+	numbers := make([]uint16, 0, len(h.Watched))
+	for _, w := range h.Watched {
+		numbers = append(numbers, w.Number)
+	}
+
+	return numbers
+}
+
+/*
+	Returns the first episode not watched after the first watched one,
+	so a skipped episode comes before the ones after it. 1 when none was watched
+*/
+func (h userHistory) NextUnwatched() uint16 {
+	if len(h.Watched) == 0 {
+		return 1
+	}
+
+	next := h.Watched[0].Number
+	for _, w := range h.Watched {
+		if w.Number != next {
+			break
+		}
+		next++
+	}
+
+	return next
+}
+
+/*
+	Returns the position of number in the sorted Watched, or where it would be
+*/
+func (h userHistory) find(number uint16) (int, bool) {
+	i := sort.Search(len(h.Watched), func(i int) bool { return h.Watched[i].Number >= number })
+	return i, i < len(h.Watched) && h.Watched[i].Number == number
+}
+
+func (h *userHistory) markWatched(episode models.Episode, at time.Time) {
+	i, found := h.find(episode.Number)
+	if found {
+		h.Watched[i].WatchedAt = at
+		if episode.ID != 0 {
+			h.Watched[i].ID = episode.ID
+		}
+	} else {
+		h.Watched = append(h.Watched, watchedEpisode{})
+		copy(h.Watched[i+1:], h.Watched[i:])
+		h.Watched[i] = watchedEpisode{Number: episode.Number, ID: episode.ID, WatchedAt: at}
+	}
+
+	h.EpisodeNumber = episode.Number
+	h.EpisodeID     = h.Watched[i].ID
+}
+
+func (h *userHistory) markUnwatched(number uint16) bool {
+	i, found := h.find(number)
+	if !found {
+		return false
+	}
+
+	h.Watched = append(h.Watched[:i], h.Watched[i+1:]...)
+	h.refreshLast()
+	return true
+}
+
+/*
+	Sets EpisodeNumber to the episode watched last, kept for who reads
+	the history as a single episode
+*/
+func (h *userHistory) refreshLast() {
+	h.EpisodeNumber, h.EpisodeID = 0, 0
+
+	var last time.Time
+	for _, w := range h.Watched {
+		if h.EpisodeNumber == 0 || !w.WatchedAt.Before(last) {
+			h.EpisodeNumber, h.EpisodeID, last = w.Number, w.ID, w.WatchedAt
+		}
+	}
+}
+
+/*
+	The histories saved before the watched episodes were tracked have only
+	the last one: every episode up to it is taken as watched
+*/
+func (h *userHistory) migrate() {
+	if h.Watched != nil {
+		return
+	}
+
+	h.Watched = make([]watchedEpisode, 0, h.EpisodeNumber)
+	for n := uint16(1); n <= h.EpisodeNumber && n > 0; n++ {
+		h.Watched = append(h.Watched, watchedEpisode{Number: n})
+	}
+
+	if h.EpisodeNumber > 0 {
+		h.Watched[len(h.Watched)-1].ID = h.EpisodeID
+	}
+}
+
 func GetInstance(name string) (*user, error) {
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
 	if instance != nil {
 		return instance, nil
 	}
@@ -71,12 +220,43 @@ func GetInstance(name string) (*user, error) {
 	instance = &user{
 		Name:    name,
 		RootDir: userRootDir,
+		EnvFile: envFile,
+	}
+
+	instance.loadFilter()
+
+	return instance, nil
+}
+/*
+	Loads the bloom filter of the downloaded files saved next to the history.
+	It's rebuilt walking RootDir when missing or when its size doesn't match
+	BLOOM_EXPECTED_ITEMS/BLOOM_FALSE_POSITIVE_RATE (or BLOOM_BITS/BLOOM_HASHES)
+*/
+func (u *user) loadFilter() {
+	bits, hashes := filterSize()
+
+	filter, err := bloomfilter.Load(u.RootDir + bloomfilter.FILTER_FILE)
+	if err == nil {
+		if m, k := filter.Size(); m == bits && k == hashes {
+			bloomfilter.SetInstance(filter)
+			return
+		}
 	}
 
+	bloomfilter.SetInstance(bloomfilter.NewWithSize(bits, hashes))
+	RebuildFilter(u.RootDir)
+}
+
+/*
+	Empties the bloom filter, adds every file under rootDir and saves it there
+*/
+func RebuildFilter(rootDir string) {
 	bloomFilter := bloomfilter.GetInstance()
-	bloomRP     := routinepoll.GetInstance().AddSubGroup("bloom", 100, 5)
+	bloomFilter.Reset()
 
-	_ = filepath.WalkDir(userRootDir, func(path string, d os.DirEntry, err error) error {
+	bloomRP := routinepoll.GetInstance().AddSubGroup("bloom", 100, 5)
+
+	_ = filepath.WalkDir(rootDir, func(path string, d os.DirEntry, err error) error {
 		if err != nil { return err }
 
 		if !d.IsDir() { 
@@ -88,12 +268,55 @@ func GetInstance(name string) (*user, error) {
 		return nil
 	})
 
-	return instance, nil
+	bloomRP.Wait()
+
+	if err := bloomFilter.Save(rootDir + bloomfilter.FILTER_FILE); err != nil {
+		fmt.Printf("⚠️ Error saving bloom filter: \n\t- %s\n", err)
+	}
 }
+
+func filterSize() (uint64, uint32) {
+	bits, errBits     := strconv.ParseUint(os.Getenv("BLOOM_BITS"), 10, 64)
+	hashes, errHashes := strconv.ParseUint(os.Getenv("BLOOM_HASHES"), 10, 32)
+	if errBits == nil && errHashes == nil && bits > 0 && hashes > 0 {
+		return bits, uint32(min(hashes, bloomfilter.MAX_HASHES))
+	}
+
+	expectedItems, err := strconv.ParseUint(os.Getenv("BLOOM_EXPECTED_ITEMS"), 10, 64)
+	if err != nil {
+		expectedItems = bloomfilter.DEFAULT_EXPECTED_ITEMS
+	}
+
+	falsePositiveRate, err := strconv.ParseFloat(os.Getenv("BLOOM_FALSE_POSITIVE_RATE"), 64)
+	if err != nil {
+		falsePositiveRate = bloomfilter.DEFAULT_FALSE_POSITIVE_RATE
+	}
+
+	return bloomfilter.OptimalSize(uint(expectedItems), falsePositiveRate)
+}
+
 /*
-  Load from disk and return the user history
+  Load from disk and return a copy of the user history
 */
 func (u *user) GetHistory() []userHistory {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loadHistory()
+
+	history := make([]userHistory, len(u.history))
+	for i, h := range u.history {
+		h.Watched  = append([]watchedEpisode{}, h.Watched...)
+		history[i] = h
+	}
+
+	return history
+}
+
+/*
+	Loads the history from disk the first time, u.mu must be held
+*/
+func (u *user) loadHistory() {
 	if u.history == nil {
 		u.history = []userHistory{}
 
@@ -102,47 +325,202 @@ func (u *user) GetHistory() []userHistory {
 
 			_ = json.Unmarshal(jsonHistory, &u.history)
 	  }
-	}
 
-	return u.history
+		for i := range u.history {
+			u.history[i].migrate()
+		}
+	}
 }
 
 /*
-	Adds a new episode to the user history
+	Adds a new episode to the user history, marking it as watched now
 */
 func (u *user) AddHistory(provider string, series models.Series, episode models.Episode) {
+	if err := u.MarkWatched(provider, series, episode); err != nil {
+		panic(err)
+	}
+}
 
-	if u.history == nil {
-		u.GetHistory()
+/*
+	Marks episodes of a series as watched now, the series is added to the history if missing
+*/
+func (u *user) MarkWatched(provider string, series models.Series, episodes ...models.Episode) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loadHistory()
+
+	history := u.seriesHistory(provider, series)
+	now     := time.Now()
+	for _, episode := range episodes {
+		history.markWatched(episode, now)
+	}
+
+	return u.saveHistory()
+}
+
+/*
+	Sets a series to episode: every episode up to it is watched, the ones after it are not.
+	The episodes already watched before it keep when they were watched
+*/
+func (u *user) SetWatchedUpTo(provider string, series models.Series, episode models.Episode) error {
+	if episode.Number == 0 {
+		return fmt.Errorf("invalid episode %d", episode.Number)
 	}
 
-	var history *userHistory
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loadHistory()
+
+	history := u.seriesHistory(provider, series)
+	now     := time.Now()
+	for n := uint16(1); n < episode.Number; n++ {
+		if !history.IsWatched(n) {
+			history.markWatched(models.Episode{Number: n}, now)
+		}
+	}
+
+	// drop the later ones before marking the episode, so it stays the last watched
+	i, found := history.find(episode.Number)
+	if found {
+		i++
+	}
+	history.Watched = history.Watched[:i]
+	history.markWatched(episode, now)
+
+	return u.saveHistory()
+}
+
+/*
+	Returns the history of a series, added when missing, u.mu must be held
+*/
+func (u *user) seriesHistory(provider string, series models.Series) *userHistory {
 	for i, h := range u.history {
-		if h.Provider  != provider   { continue }
-		if h.SeriesID   != series.ID   { continue }
-
-		history = &u.history[i]
-		break
-	}
-
-	if history == nil {
-	  history = &userHistory{
-			Provider          : provider,
-			SeriesID          : series.ID,
-			SeriesName        : series.Name,
-			SeriesSlug        : series.Slug,
-			SeriesTotEpisodes : uint16(series.Episodes),
-			EpisodeID         : episode.ID,
-			EpisodeNumber     : episode.Number,
-	  }
-	  u.history = append(u.history, *history)
-	} else {
-		history.EpisodeNumber = episode.Number
-		history.EpisodeID     = episode.ID
+		if h.SeriesID != series.ID { continue }
+		if h.Provider != provider && h.Provider != "" { continue }
+
+		return &u.history[i]
 	}
 
+  u.history = append(u.history, userHistory{
+		Provider          : provider,
+		SeriesID          : series.ID,
+		SeriesName        : series.Name,
+		SeriesSlug        : series.Slug,
+		SeriesTotEpisodes : uint16(series.Episodes),
+		Watched           : []watchedEpisode{},
+  })
+
+	return &u.history[len(u.history)-1]
+}
+
+/*
+	Marks episodes of a series as not watched, returns false if the series is not in the history
+*/
+func (u *user) MarkUnwatched(provider string, seriesID string, numbers ...uint16) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loadHistory()
+
+	for i, h := range u.history {
+		if h.SeriesID != seriesID { continue }
+		if h.Provider != provider && h.Provider != "" { continue }
+
+		for _, number := range numbers {
+			u.history[i].markUnwatched(number)
+		}
+		return true, u.saveHistory()
+	}
+
+	return false, nil
+}
+
+/*
+	Refreshes name, slug and total episodes of a series in the history,
+	returns false if it was not there
+*/
+func (u *user) UpdateSeries(provider string, series models.Series) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loadHistory()
+
+	for i, h := range u.history {
+		if h.SeriesID != series.ID { continue }
+		if h.Provider != provider && h.Provider != "" { continue }
+
+		u.history[i].SeriesName        = series.Name
+		u.history[i].SeriesSlug        = series.Slug
+		u.history[i].SeriesTotEpisodes = uint16(series.Episodes)
+		return true, u.saveHistory()
+	}
+
+	return false, nil
+}
+
+/*
+	Removes a series from the user history, returns false if it was not there
+*/
+func (u *user) RemoveHistory(provider string, seriesID string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loadHistory()
+
+	for i, h := range u.history {
+		if h.SeriesID != seriesID { continue }
+		if h.Provider != provider && h.Provider != "" { continue }
+
+		u.history = append(u.history[:i], u.history[i+1:]...)
+		return true, u.saveHistory()
+	}
+
+	return false, nil
+}
+
+/*
+	Writes the history to disk, u.mu must be held.
+	The file is written aside and renamed so readers never see it half written
+*/
+func (u *user) saveHistory() error {
 	jsonHistory, _ := json.Marshal(u.history)
-	err := os.WriteFile(u.RootDir + HISTORY_FILE, jsonHistory, 0664); if err != nil {
-		panic(err)
+
+	if err := os.WriteFile(u.RootDir + HISTORY_FILE + ".tmp", jsonHistory, 0664); err != nil {
+		return err
 	}
+
+	return os.Rename(u.RootDir + HISTORY_FILE + ".tmp", u.RootDir + HISTORY_FILE)
+}
+
+/*
+	Returns the variables set in the user env file
+*/
+func (u *user) GetConfig() (map[string]string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return godotenv.Read(u.EnvFile)
+}
+
+/*
+	Sets a variable in the user env file and in the current environment
+*/
+func (u *user) SetConfig(key string, value string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	config, err := godotenv.Read(u.EnvFile)
+	if err != nil {
+		return fmt.Errorf("error reading env file: %s", err)
+	}
+
+	config[key] = value
+
+	if err := godotenv.Write(config, u.EnvFile); err != nil {
+		return fmt.Errorf("error writing env file: %s", err)
+	}
+
+	return os.Setenv(key, value)
 }
@@ -0,0 +1,156 @@
+package user
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/IceWizard98/series_downloader/models"
+)
+
+const (
+	TEST_SERIES   = 4
+	TEST_EPISODES = 50
+)
+
+func testSeries(i int) models.Series {
+	return models.Series{
+		ID:       fmt.Sprintf("%d", i+1),
+		Name:     fmt.Sprintf("Series %d", i+1),
+		Slug:     fmt.Sprintf("series-%d", i+1),
+		Episodes: TEST_EPISODES,
+	}
+}
+
+/*
+	Adds the episodes of a few series from many goroutines while the history is read,
+	run it with -race. Every episode must be watched, in memory and on disk
+*/
+func TestConcurrentAddHistory(t *testing.T) {
+	u := &user{RootDir: t.TempDir()}
+
+	var wg sync.WaitGroup
+	for s := range TEST_SERIES {
+		for e := range TEST_EPISODES {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				u.AddHistory("animeunity", testSeries(s), models.Episode{ID: uint(s*1000 + e), Number: uint16(e + 1)})
+			}()
+
+			go func() {
+				defer wg.Done()
+				for _, h := range u.GetHistory() {
+					h.WatchedNumbers()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	// a fresh user reads what was saved
+	for _, current := range []*user{u, {RootDir: u.RootDir}} {
+		history := current.GetHistory()
+		if len(history) != TEST_SERIES {
+			t.Fatalf("got %d series in the history, want %d", len(history), TEST_SERIES)
+		}
+
+		for _, h := range history {
+			if watched := h.WatchedNumbers(); len(watched) != TEST_EPISODES {
+				t.Errorf("series %s has %d watched episodes, want %d", h.SeriesID, len(watched), TEST_EPISODES)
+			}
+
+			if next := h.NextUnwatched(); next != TEST_EPISODES+1 {
+				t.Errorf("series %s continues from %d, want %d", h.SeriesID, next, TEST_EPISODES+1)
+			}
+		}
+	}
+}
+
+/*
+	Marks and unmarks episodes of the same series from many goroutines, run it with -race
+*/
+func TestConcurrentMarkUnwatched(t *testing.T) {
+	u      := &user{RootDir: t.TempDir()}
+	series := testSeries(0)
+
+	var wg sync.WaitGroup
+	for e := range TEST_EPISODES {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			number := uint16(e + 1)
+			if err := u.MarkWatched("animeunity", series, models.Episode{Number: number}); err != nil {
+				t.Errorf("error marking episode %d as watched: %s", number, err)
+				return
+			}
+
+			// the odd episodes are unmarked again
+			if number%2 == 1 {
+				if _, err := u.MarkUnwatched("animeunity", series.ID, number); err != nil {
+					t.Errorf("error marking episode %d as not watched: %s", number, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	history := u.GetHistory()
+	if len(history) != 1 {
+		t.Fatalf("got %d series in the history, want 1", len(history))
+	}
+
+	for e := range uint16(TEST_EPISODES) {
+		number := e + 1
+		if watched := history[0].IsWatched(number); watched != (number%2 == 0) {
+			t.Errorf("episode %d watched = %t", number, watched)
+		}
+	}
+
+	// the first watched is 2, so 3 is the first skipped after it
+	if next := history[0].NextUnwatched(); next != 3 {
+		t.Errorf("continues from %d, want 3", next)
+	}
+}
+
+func TestSetWatchedUpTo(t *testing.T) {
+	u      := &user{RootDir: t.TempDir()}
+	series := testSeries(0)
+
+	if err := u.MarkWatched("animeunity", series, models.Episode{Number: 2}, models.Episode{Number: 4}, models.Episode{Number: 9}); err != nil {
+		t.Fatal(err)
+	}
+	before := u.GetHistory()[0].Watched
+
+	if err := u.SetWatchedUpTo("animeunity", series, models.Episode{ID: 500, Number: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := u.GetHistory()[0]
+	if watched := h.WatchedNumbers(); !reflect.DeepEqual(watched, []uint16{1, 2, 3, 4, 5}) {
+		t.Errorf("got watched %v, want 1-5", watched)
+	}
+
+	if h.EpisodeNumber != 5 || h.EpisodeID != 500 {
+		t.Errorf("last episode %d (id %d), want 5 (id 500)", h.EpisodeNumber, h.EpisodeID)
+	}
+
+	// the episodes already watched keep when they were watched
+	if !h.Watched[1].WatchedAt.Equal(before[0].WatchedAt) || !h.Watched[3].WatchedAt.Equal(before[1].WatchedAt) {
+		t.Error("the episodes watched before were marked again")
+	}
+
+	if err := u.SetWatchedUpTo("animeunity", series, models.Episode{Number: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	if watched := u.GetHistory()[0].WatchedNumbers(); !reflect.DeepEqual(watched, []uint16{1, 2, 3}) {
+		t.Errorf("got watched %v, want 1-3", watched)
+	}
+
+	if err := u.SetWatchedUpTo("animeunity", series, models.Episode{Number: 0}); err == nil {
+		t.Error("no error for episode 0")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/IceWizard98/series_downloader/models/queue"
+	"github.com/IceWizard98/series_downloader/models/user"
+	progressbar "github.com/IceWizard98/series_downloader/utils/progressBar"
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+)
+
+/*
+	queue [flags] list | retry [id...] | drop [id...]
+*/
+func runQueue(args []string) error {
+	fs       := newFlagSet("queue", "[flags] list | retry [id...] | drop [id...]", "Show or change the download queue, retry without ids resumes every unfinished job")
+	flags    := addCommonFlags(fs)
+	finished := fs.Bool("finished", false, "With drop, remove every done, failed or cancelled job")
+	quality  := addQualityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := applyQuality(*quality); err != nil {
+		return err
+	}
+
+	action := fs.Arg(0)
+	if action == "" {
+		action = "list"
+	}
+
+	ids := make([]uint64, 0, fs.NArg())
+	for _, arg := range fs.Args()[min(1, fs.NArg()):] {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid job id %s", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	if *flags.json {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*flags.userName)
+	if err != nil {
+		return err
+	}
+
+	q, err := queue.New(u.RootDir, routinepoll.MaxConcurrentDownloads())
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "list":
+		printQueue(q.List(), *flags.json)
+		return nil
+
+	case "retry":
+		bars := progressbar.Start()
+		q.OnProgress = bars.Update
+		q.OnFinish   = func(job queue.Job) {
+			bars.Done(job.Series.Slug, job.Episode.Number)
+		}
+
+		if len(ids) == 0 {
+			for _, job := range q.List() {
+				if job.State == queue.STATE_FAILED || job.State == queue.STATE_CANCELLED {
+					ids = append(ids, job.ID)
+				}
+			}
+			q.Resume()
+		}
+
+		for _, id := range ids {
+			if err := q.Retry(id); err != nil {
+				fmt.Printf("⚠️ %s\n", err)
+			}
+		}
+
+		q.Wait()
+		bars.Stop()
+
+		jobs   := q.List()
+		failed := 0
+		for _, job := range jobs {
+			if job.State == queue.STATE_FAILED {
+				failed++
+			}
+		}
+
+		printQueue(jobs, *flags.json)
+		if failed > 0 {
+			return fmt.Errorf("%d jobs failed", failed)
+		}
+
+	case "drop":
+		if *finished {
+			for _, job := range q.List() {
+				if job.State == queue.STATE_DONE || job.State == queue.STATE_FAILED || job.State == queue.STATE_CANCELLED {
+					ids = append(ids, job.ID)
+				}
+			}
+		}
+
+		if len(ids) == 0 {
+			fs.Usage()
+			return errors.New("missing job ids")
+		}
+
+		for _, id := range ids {
+			if err := q.Drop(id); err != nil {
+				return err
+			}
+			fmt.Printf("❌ Dropped job %d\n", id)
+		}
+
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown action %s", action)
+	}
+
+	return nil
+}
+
+func printQueue(jobs []queue.Job, asJSON bool) {
+	if asJSON {
+		printJSON(jobs)
+		return
+	}
+
+	if len(jobs) == 0 {
+		fmt.Println("The download queue is empty")
+		return
+	}
+
+	for _, job := range jobs {
+		line := fmt.Sprintf("%4d %-9s %s - episode %d", job.ID, job.State, job.Series.Name, job.Episode.Number)
+		if job.Total > 0 && job.State != queue.STATE_DONE {
+			line += fmt.Sprintf(" (%s/%s)", progressbar.FormatBytes(job.Downloaded), progressbar.FormatBytes(job.Total))
+		}
+		if job.Error != "" {
+			line += ": " + job.Error
+		}
+
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/IceWizard98/series_downloader/models"
+	fuzzyselect "github.com/IceWizard98/series_downloader/utils/fuzzySelect"
+)
+
+/*
+	Returned when a choice can't be made from the flags and the
+	prompt is disabled by --yes or --json
+*/
+var errAmbiguous = errors.New("ambiguous choice")
+
+const (
+	SELECT_ALL     = "all"
+	SELECT_MISSING = "missing"
+)
+
+var stdin = bufio.NewReader(os.Stdin)
+
+/*
+	How a series is picked from a list: by id, by slug, by position
+	or, when interactive, asking on stdin.
+	History has the ids of the series in the history, to show it in the selector
+*/
+type seriesFilter struct {
+	ID          string
+	Slug        string
+	Pick        uint
+	Interactive bool
+	History     map[string]bool
+}
+
+func (f seriesFilter) isSet() bool {
+	return f.ID != "" || f.Slug != "" || f.Pick > 0
+}
+
+/*
+	Picks a series from seriesList applying the filter.
+	label is used to print every entry when the user is asked to choose
+*/
+func selectSeries(seriesList []models.Series, filter seriesFilter, label func(i int, series models.Series) string) (models.Series, error) {
+	candidates := make([]models.Series, 0, len(seriesList))
+	for _, series := range seriesList {
+		if filter.ID != "" && series.ID != filter.ID {
+			continue
+		}
+
+		if filter.Slug != "" && series.Slug != filter.Slug {
+			continue
+		}
+
+		candidates = append(candidates, series)
+	}
+
+	if len(candidates) == 0 {
+		return models.Series{}, fmt.Errorf("no results found")
+	}
+
+	if filter.Pick > 0 {
+		if filter.Pick > uint(len(candidates)) {
+			return models.Series{}, fmt.Errorf("invalid --pick %d, only %d results", filter.Pick, len(candidates))
+		}
+
+		return candidates[filter.Pick-1], nil
+	}
+
+	if len(candidates) == 1 && (filter.ID != "" || filter.Slug != "" || !filter.Interactive) {
+		return candidates[0], nil
+	}
+
+	if !filter.Interactive {
+		return models.Series{}, fmt.Errorf("%w: %d series found, use --series-id, --slug or --pick", errAmbiguous, len(candidates))
+	}
+
+	if fuzzyselect.Available() {
+		items := make([]fuzzyselect.Item, 0, len(candidates))
+		for _, series := range candidates {
+			items = append(items, fuzzyselect.Item{
+				Label:   fmt.Sprintf("%s (%s)", series.Name, series.Slug),
+				Preview: seriesPreview(series, filter.History[series.ID]),
+			})
+		}
+
+		result, err := fuzzyselect.Select("Select a series", items)
+		if err != nil {
+			return models.Series{}, err
+		}
+
+		if result.Index < 0 {
+			return models.Series{}, fmt.Errorf("no series matches %q", result.Query)
+		}
+
+		return candidates[result.Index], nil
+	}
+
+	for i, v := range candidates {
+		fmt.Println(label(i, v))
+	}
+
+	fmt.Println("Select a series")
+	index, err := readIndex(len(candidates))
+	if err != nil {
+		return models.Series{}, err
+	}
+
+	return candidates[index], nil
+}
+
+/*
+	The lines shown in the selector for the highlighted series
+*/
+func seriesPreview(series models.Series, inHistory bool) []string {
+	episodes := "unknown"
+	if series.Episodes > 0 {
+		episodes = strconv.FormatUint(uint64(series.Episodes), 10)
+	}
+
+	history := "no"
+	if inHistory {
+		history = "yes"
+	}
+
+	preview := []string{
+		series.Name,
+		fmt.Sprintf("Slug: %s, id: %s", series.Slug, series.ID),
+		"Episodes: " + episodes,
+		"In your history: " + history,
+	}
+
+	details := strings.Join(series.Genres, ", ")
+	if series.Year > 0 {
+		details = strings.TrimSpace(fmt.Sprintf("%d %s", series.Year, details))
+	}
+
+	if details != "" {
+		preview = append(preview, details)
+	}
+
+	return preview
+}
+
+/*
+	Reads a 1-based position from stdin and returns it as 0-based index
+*/
+func readIndex(size int) (int, error) {
+	selected, _ := stdin.ReadString('\n')
+	selected     = strings.TrimSpace(selected)
+
+	if selected == "" || len(selected) == 0 {
+		return 0, fmt.Errorf("invalid selection")
+	}
+
+	for _, char := range selected {
+		if !unicode.IsDigit(char) {
+			return 0, fmt.Errorf("only digit are allowed")
+		}
+	}
+
+	index_selected, err := strconv.ParseUint(selected, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid selection")
+	}
+
+	if index_selected < 1 || uint16(index_selected) > uint16(size) {
+		return 0, fmt.Errorf("invalid selection")
+	}
+
+	return int(index_selected - 1), nil
+}
+
+/*
+	Reads from stdin a selection of episodes, see parseEpisodeSelection
+*/
+func readSelection() (episodeSelection, error) {
+	selected, _ := stdin.ReadString('\n')
+	selected     = strings.TrimSpace(selected)
+
+	if selected == "" {
+		return episodeSelection{}, fmt.Errorf("invalid selection")
+	}
+
+	return parseEpisodeSelection(selected)
+}
+
+/*
+	Reads a yes/no answer from stdin
+*/
+func readConfirm() bool {
+	answer, _ := stdin.ReadString('\n')
+	answer     = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y"
+}
+
+/*
+	Parses a list of episode numbers and ranges like "3-7,10".
+	The result is sorted and without duplicates
+*/
+func parseEpisodeRanges(spec string) ([]uint16, error) {
+	seen    := make(map[uint16]bool)
+	numbers := []uint16{}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid episode %q", part)
+		}
+
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid episode range %q", part)
+			}
+		}
+
+		if start == 0 || end < start {
+			return nil, fmt.Errorf("invalid episode range %q", part)
+		}
+
+		for n := start; n <= end; n++ {
+			if !seen[uint16(n)] {
+				seen[uint16(n)] = true
+				numbers = append(numbers, uint16(n))
+			}
+		}
+	}
+
+	if len(numbers) == 0 {
+		return nil, fmt.Errorf("no episodes in %q", spec)
+	}
+
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers, nil
+}
+
+/*
+	Which episodes to download: all of them, the ones not on disk yet or a list of numbers
+*/
+type episodeSelection struct {
+	All     bool
+	Missing bool
+	Numbers []uint16
+}
+
+/*
+	Parses "all", "missing" or a list of numbers and ranges like "5,7,9-11"
+*/
+func parseEpisodeSelection(spec string) (episodeSelection, error) {
+	switch strings.ToLower(strings.TrimSpace(spec)) {
+	case SELECT_ALL:
+		return episodeSelection{All: true}, nil
+	case SELECT_MISSING:
+		return episodeSelection{Missing: true}, nil
+	}
+
+	numbers, err := parseEpisodeRanges(spec)
+	if err != nil {
+		return episodeSelection{}, err
+	}
+
+	return episodeSelection{Numbers: numbers}, nil
+}
+
+/*
+	True when a single episode was selected
+*/
+func (s episodeSelection) single() bool {
+	return len(s.Numbers) == 1
+}
+
+/*
+	The first and the last episode to ask the provider for
+*/
+func (s episodeSelection) bounds() (uint, uint) {
+	if len(s.Numbers) == 0 {
+		return 1, math.MaxUint
+	}
+
+	return uint(s.Numbers[0]), uint(s.Numbers[len(s.Numbers)-1])
+}
+
+/*
+	Returns the selected episodes. The numbers are positions in episodes, as printed
+	by the picker, when byPosition is true, otherwise episode numbers.
+	onDisk tells which episodes are left out by missing
+*/
+func (s episodeSelection) apply(episodes []models.Episode, byPosition bool, onDisk func(models.Episode) (string, bool)) ([]models.Episode, error) {
+	switch {
+	case s.All:
+		return episodes, nil
+
+	case s.Missing:
+		missing := []models.Episode{}
+		for _, episode := range episodes {
+			if _, ok := onDisk(episode); !ok {
+				missing = append(missing, episode)
+			}
+		}
+		return missing, nil
+	}
+
+	selected := make([]models.Episode, 0, len(s.Numbers))
+
+	if byPosition {
+		for _, position := range s.Numbers {
+			if int(position) > len(episodes) {
+				return nil, fmt.Errorf("invalid selection %d, only %d episodes", position, len(episodes))
+			}
+			selected = append(selected, episodes[position-1])
+		}
+		return selected, nil
+	}
+
+	byNumber := make(map[uint16]models.Episode, len(episodes))
+	for _, episode := range episodes {
+		byNumber[episode.Number] = episode
+	}
+
+	for _, number := range s.Numbers {
+		episode, ok := byNumber[number]
+		if !ok {
+			return nil, fmt.Errorf("episode %d not found", number)
+		}
+		selected = append(selected, episode)
+	}
+
+	return selected, nil
+}
+
+/*
+	Asks which episodes to download: one, to watch it, or a selection like 1-12, all
+	or missing to only download them. single is true when one episode was picked
+*/
+func pickEpisodes(episodes []models.Episode, onDisk func(models.Episode) (string, bool)) ([]models.Episode, bool, error) {
+	hint := fmt.Sprintf("Select an episode, or more like 1-12, 5,7,9-11, %s or %s", SELECT_ALL, SELECT_MISSING)
+
+	if fuzzyselect.Available() {
+		items := make([]fuzzyselect.Item, 0, len(episodes))
+		for _, episode := range episodes {
+			status := "Not downloaded"
+			if path, ok := onDisk(episode); ok {
+				status = "Downloaded: " + path
+			}
+
+			items = append(items, fuzzyselect.Item{
+				Label:   fmt.Sprintf("Episode %d", episode.Number),
+				Preview: []string{fmt.Sprintf("Episode %d", episode.Number), status},
+			})
+		}
+
+		result, err := fuzzyselect.Select(hint, items)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// the list shows the episode numbers, so what is typed is read as episode numbers
+		if selection, err := parseEpisodeSelection(result.Query); err == nil && !selection.single() {
+			selected, err := selection.apply(episodes, false, onDisk)
+			return selected, false, err
+		}
+
+		if result.Index < 0 {
+			return nil, false, fmt.Errorf("no episode matches %q", result.Query)
+		}
+
+		return []models.Episode{episodes[result.Index]}, true, nil
+	}
+
+	for i, v := range episodes {
+		fmt.Printf("%d - %d\n", i+1, v.Number)
+	}
+
+	fmt.Println(hint)
+	selection, err := readSelection()
+	if err != nil {
+		return nil, false, err
+	}
+
+	selected, err := selection.apply(episodes, true, onDisk)
+	return selected, selection.single(), err
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IceWizard98/series_downloader/models"
+)
+
+func TestParseEpisodeRanges(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		want []uint16
+		err  string
+	}{
+		{spec: "3", want: []uint16{3}},
+		{spec: "3-7,10", want: []uint16{3, 4, 5, 6, 7, 10}},
+		{spec: " 10 , 3 - 5 ", want: []uint16{3, 4, 5, 10}},
+		{spec: "5,3-6,5", want: []uint16{3, 4, 5, 6}},
+		{spec: "1,,2,", want: []uint16{1, 2}},
+		{spec: "7-7", want: []uint16{7}},
+		{spec: "", err: "no episodes"},
+		{spec: ",", err: "no episodes"},
+		{spec: "0", err: "invalid episode range"},
+		{spec: "7-3", err: "invalid episode range"},
+		{spec: "3-x", err: "invalid episode range"},
+		{spec: "x", err: "invalid episode"},
+		{spec: "-3", err: "invalid episode"},
+		{spec: "70000", err: "invalid episode"},
+	} {
+		numbers, err := parseEpisodeRanges(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.spec, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(numbers, test.want) {
+			t.Errorf("%q: got %v, want %v", test.spec, numbers, test.want)
+		}
+	}
+}
+
+func TestParseEpisodeSelection(t *testing.T) {
+	for _, test := range []struct {
+		spec   string
+		want   episodeSelection
+		single bool
+		start  uint
+		end    uint
+	}{
+		{spec: "all", want: episodeSelection{All: true}, start: 1, end: math.MaxUint},
+		{spec: " ALL ", want: episodeSelection{All: true}, start: 1, end: math.MaxUint},
+		{spec: "Missing", want: episodeSelection{Missing: true}, start: 1, end: math.MaxUint},
+		{spec: "4", want: episodeSelection{Numbers: []uint16{4}}, single: true, start: 4, end: 4},
+		{spec: "9-11,5", want: episodeSelection{Numbers: []uint16{5, 9, 10, 11}}, start: 5, end: 11},
+	} {
+		selection, err := parseEpisodeSelection(test.spec)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(selection, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.spec, selection, test.want)
+		}
+
+		if selection.single() != test.single {
+			t.Errorf("%q: single() = %t", test.spec, selection.single())
+		}
+
+		if start, end := selection.bounds(); start != test.start || end != test.end {
+			t.Errorf("%q: bounds() = %d, %d, want %d, %d", test.spec, start, end, test.start, test.end)
+		}
+	}
+
+	if _, err := parseEpisodeSelection("some"); err == nil {
+		t.Error("no error for an invalid selection")
+	}
+}
+
+func TestEpisodeSelectionApply(t *testing.T) {
+	// the provider lists from episode 10, positions and numbers differ
+	episodes := []models.Episode{}
+	for n := uint16(10); n <= 14; n++ {
+		episodes = append(episodes, models.Episode{ID: uint(n) * 100, Number: n})
+	}
+
+	onDisk := func(episode models.Episode) (string, bool) {
+		return "/downloads/episode", episode.Number == 11 || episode.Number == 13
+	}
+
+	numbers := func(episodes []models.Episode) []uint16 {
+		result := []uint16{}
+		for _, episode := range episodes {
+			result = append(result, episode.Number)
+		}
+		return result
+	}
+
+	for _, test := range []struct {
+		spec       string
+		byPosition bool
+		want       []uint16
+		err        string
+	}{
+		{spec: "all", want: []uint16{10, 11, 12, 13, 14}},
+		{spec: "missing", want: []uint16{10, 12, 14}},
+		{spec: "10,12-13", want: []uint16{10, 12, 13}},
+		{spec: "1,3-4", byPosition: true, want: []uint16{10, 12, 13}},
+		{spec: "5", byPosition: true, want: []uint16{14}},
+		{spec: "6", byPosition: true, err: "only 5 episodes"},
+		{spec: "9-10", err: "episode 9 not found"},
+	} {
+		selection, err := parseEpisodeSelection(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %s", test.spec, err)
+		}
+
+		selected, err := selection.apply(episodes, test.byPosition, onDisk)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.spec, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+
+		if got := numbers(selected); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q by position %t: got %v, want %v", test.spec, test.byPosition, got, test.want)
+		}
+	}
+}
+
+var testSeriesList = []models.Series{
+	{ID: "1", Name: "Naruto", Slug: "naruto", Episodes: 220},
+	{ID: "2", Name: "Naruto Shippuden", Slug: "naruto-shippuden", Episodes: 500},
+	{ID: "3", Name: "Boruto", Slug: "boruto", Episodes: 293},
+}
+
+func TestSelectSeries(t *testing.T) {
+	label := func(i int, series models.Series) string { return series.Slug }
+
+	for name, test := range map[string]struct {
+		list   []models.Series
+		filter seriesFilter
+		want   string
+		err    error
+		errMsg string
+	}{
+		"by id":             {list: testSeriesList, filter: seriesFilter{ID: "2"}, want: "naruto-shippuden"},
+		"by slug":           {list: testSeriesList, filter: seriesFilter{Slug: "boruto"}, want: "boruto"},
+		"by id and pick":    {list: testSeriesList, filter: seriesFilter{ID: "3", Pick: 1}, want: "boruto"},
+		"by pick":           {list: testSeriesList, filter: seriesFilter{Pick: 2}, want: "naruto-shippuden"},
+		"single result":     {list: testSeriesList[:1], filter: seriesFilter{}, want: "naruto"},
+		"pick out of range": {list: testSeriesList, filter: seriesFilter{Pick: 4}, errMsg: "only 3 results"},
+		"unknown id":        {list: testSeriesList, filter: seriesFilter{ID: "9"}, errMsg: "no results found"},
+		"id and slug":       {list: testSeriesList, filter: seriesFilter{ID: "1", Slug: "boruto"}, errMsg: "no results found"},
+		"no results":        {list: nil, filter: seriesFilter{}, errMsg: "no results found"},
+		"ambiguous":         {list: testSeriesList, filter: seriesFilter{}, err: errAmbiguous},
+	} {
+		series, err := selectSeries(test.list, test.filter, label)
+
+		switch {
+		case test.err != nil:
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: got error %v, want %v", name, err, test.err)
+			}
+
+		case test.errMsg != "":
+			if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+				t.Errorf("%s: got error %v, want %q", name, err, test.errMsg)
+			}
+
+		case err != nil:
+			t.Errorf("%s: %s", name, err)
+
+		case series.Slug != test.want:
+			t.Errorf("%s: got %s, want %s", name, series.Slug, test.want)
+		}
+	}
+}
+
+/*
+	A provider returning the same results for every search
+*/
+type fakeProvider struct {
+	results  []models.Series
+	searches int
+}
+
+func (p *fakeProvider) Name() string { return "fake" }
+
+func (p *fakeProvider) Search(ctx context.Context, query string) ([]models.Series, error) {
+	p.searches++
+	return p.results, nil
+}
+
+func (p *fakeProvider) GetEpisodes(ctx context.Context, series models.Series, start uint, end uint) ([]models.Episode, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *fakeProvider) DownloadEpisode(ctx context.Context, series models.Series, episode models.Episode, rootDir string, onProgress models.ProgressFunc) (string, error) {
+	return "", errors.New("not implemented")
+}
+
+func TestResolveSeries(t *testing.T) {
+	history := []models.Series{{ID: "7", Name: "One Piece", Slug: "one-piece"}}
+
+	for name, test := range map[string]struct {
+		query    string
+		filter   seriesFilter
+		want     string
+		searches int
+		err      error
+	}{
+		"history id":      {query: "7", want: "one-piece"},
+		"history slug":    {query: "one-piece", want: "one-piece"},
+		"search id":       {query: "3", want: "boruto", searches: 1},
+		"search slug":     {query: "naruto", want: "naruto", searches: 1},
+		"search and pick": {query: "Naruto", filter: seriesFilter{Pick: 2}, want: "naruto-shippuden", searches: 1},
+		"ambiguous":       {query: "Naruto", searches: 1, err: errAmbiguous},
+	} {
+		provider    := &fakeProvider{results: testSeriesList}
+		series, err := resolveSeries(provider, history, test.query, test.filter)
+
+		if provider.searches != test.searches {
+			t.Errorf("%s: searched %d times, want %d", name, provider.searches, test.searches)
+		}
+
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: got error %v, want %v", name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if series.Slug != test.want {
+			t.Errorf("%s: got %s, want %s", name, series.Slug, test.want)
+		}
+	}
+}
+
+func TestUnwatchedEnd(t *testing.T) {
+	watched := map[uint16]bool{6: true, 7: true, 9: true}
+	isWatched := func(number uint16) bool { return watched[number] }
+
+	for _, test := range []struct {
+		after uint16
+		count uint
+		want  uint
+	}{
+		{after: 0, count: 3, want: 3},
+		{after: 5, count: 0, want: 5},
+		{after: 5, count: 1, want: 8},
+		{after: 5, count: 3, want: 11},
+		{after: math.MaxUint16 - 1, count: 5, want: math.MaxUint16},
+	} {
+		if got := unwatchedEnd(test.after, test.count, isWatched); got != test.want {
+			t.Errorf("unwatchedEnd(%d, %d) = %d, want %d", test.after, test.count, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/queue"
+	"github.com/IceWizard98/series_downloader/models/user"
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+)
+
+const (
+	SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+/*
+	Daemon exposing search, episodes, download queue and history as a JSON API
+*/
+type Server struct {
+	userName string
+	queue    *queue.Queue
+
+	seriesMu sync.Mutex
+	series   map[string]models.Series
+}
+
+type downloadRequest struct {
+	Provider string   `json:"provider"`
+	SeriesID string   `json:"series_id"`
+	Episodes []uint16 `json:"episodes"`
+}
+
+type historyRequest struct {
+	Provider      string `json:"provider"`
+	SeriesID      string `json:"series_id"`
+	EpisodeNumber uint16 `json:"episode_number"`
+}
+
+func New(userName string, q *queue.Queue) *Server {
+	return &Server{
+		userName: userName,
+		queue:    q,
+		series:   make(map[string]models.Series),
+	}
+}
+
+/*
+	Starts listening on addr, blocks until the server stops.
+	When ctx is cancelled the running requests are given a few seconds to complete
+*/
+func Start(ctx context.Context, addr string, userName string) error {
+	u, err := user.GetInstance(userName)
+	if err != nil {
+		return err
+	}
+
+	q, err := queue.New(u.RootDir, routinepoll.MaxConcurrentDownloads())
+	if err != nil {
+		return err
+	}
+
+	if resumed := q.Resume(); resumed > 0 {
+		fmt.Printf("🔄 Resuming %d unfinished downloads\n", resumed)
+	}
+
+	s := New(userName, q)
+
+	httpServer := &http.Server{
+		Addr:        addr,
+		Handler:     s.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		_ = httpServer.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("🌐 Listening on %s\n", addr)
+	err = httpServer.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /search",            s.handleSearch)
+	mux.HandleFunc("GET /episodes",          s.handleEpisodes)
+	mux.HandleFunc("GET /downloads",         s.handleListDownloads)
+	mux.HandleFunc("POST /downloads",        s.handleEnqueue)
+	mux.HandleFunc("DELETE /downloads/{id}", s.handleCancel)
+	mux.HandleFunc("POST /downloads/{id}/retry", s.handleRetry)
+	mux.HandleFunc("GET /history",           s.handleGetHistory)
+	mux.HandleFunc("PUT /history",           s.handleSetHistory)
+
+	return mux
+}
+
+/*
+	GET /search?title=<title>&provider=<provider>
+*/
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing title"))
+		return
+	}
+
+	provider, err := models.GetProvider(r.URL.Query().Get("provider"))
+	if provider == nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	seriesList, err := provider.Search(r.Context(), title)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	s.seriesMu.Lock()
+	for _, series := range seriesList {
+		s.series[seriesKey(provider.Name(), series.ID)] = series
+	}
+	s.seriesMu.Unlock()
+
+	writeJSON(w, http.StatusOK, seriesList)
+}
+
+/*
+	GET /episodes?provider=<provider>&series_id=<id>[&start=<n>&end=<n>]
+*/
+func (s *Server) handleEpisodes(w http.ResponseWriter, r *http.Request) {
+	provider, series, status, err := s.resolveSeries(r.URL.Query().Get("provider"), r.URL.Query().Get("series_id"))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	start, err := parseUintParam(r, "start", 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	end, err := parseUintParam(r, "end", math.MaxUint)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	episodes, err := provider.GetEpisodes(r.Context(), series, start, end)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, episodes)
+}
+
+/*
+	GET /downloads
+*/
+func (s *Server) handleListDownloads(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.queue.List())
+}
+
+/*
+	POST /downloads {"provider": "...", "series_id": "...", "episodes": [1, 2]}
+*/
+func (s *Server) handleEnqueue(w http.ResponseWriter, r *http.Request) {
+	var request downloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %s", err))
+		return
+	}
+
+	if len(request.Episodes) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no episodes requested"))
+		return
+	}
+
+	provider, series, status, err := s.resolveSeries(request.Provider, request.SeriesID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	first, last := request.Episodes[0], request.Episodes[0]
+	for _, number := range request.Episodes {
+		first = min(first, number)
+		last  = max(last, number)
+	}
+
+	episodes, err := provider.GetEpisodes(r.Context(), series, uint(first), uint(last))
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	byNumber := make(map[uint16]models.Episode, len(episodes))
+	for _, episode := range episodes {
+		byNumber[episode.Number] = episode
+	}
+
+	// every episode is looked up first, so a missing one queues nothing
+	requested := make([]models.Episode, 0, len(request.Episodes))
+	for _, number := range request.Episodes {
+		episode, ok := byNumber[number]
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("episode %d not found", number))
+			return
+		}
+
+		requested = append(requested, episode)
+	}
+
+	jobs := make([]queue.Job, 0, len(requested))
+	for _, episode := range requested {
+		jobs = append(jobs, s.queue.Enqueue(provider.Name(), series, episode))
+	}
+
+	writeJSON(w, http.StatusAccepted, jobs)
+}
+
+/*
+	DELETE /downloads/{id}
+*/
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id %s", r.PathValue("id")))
+		return
+	}
+
+	if _, ok := s.queue.Get(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %d not found", id))
+		return
+	}
+
+	if err := s.queue.Cancel(id); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	job, _ := s.queue.Get(id)
+	writeJSON(w, http.StatusOK, job)
+}
+
+/*
+	POST /downloads/{id}/retry
+*/
+func (s *Server) handleRetry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid job id %s", r.PathValue("id")))
+		return
+	}
+
+	if _, ok := s.queue.Get(id); !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %d not found", id))
+		return
+	}
+
+	if err := s.queue.Retry(id); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	job, _ := s.queue.Get(id)
+	writeJSON(w, http.StatusOK, job)
+}
+
+/*
+	GET /history
+*/
+func (s *Server) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	u, err := user.GetInstance(s.userName)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u.GetHistory())
+}
+
+/*
+	PUT /history {"provider": "...", "series_id": "...", "episode_number": 3}
+*/
+func (s *Server) handleSetHistory(w http.ResponseWriter, r *http.Request) {
+	var request historyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid body: %s", err))
+		return
+	}
+
+	if request.EpisodeNumber == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("missing episode_number"))
+		return
+	}
+
+	provider, series, status, err := s.resolveSeries(request.Provider, request.SeriesID)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	episode := models.Episode{Number: request.EpisodeNumber}
+
+	// the episode id is best effort, the history works with the number alone
+	episodes, err := provider.GetEpisodes(r.Context(), series, uint(request.EpisodeNumber), uint(request.EpisodeNumber))
+	if err == nil {
+		for _, e := range episodes {
+			if e.Number == request.EpisodeNumber {
+				episode = e
+				break
+			}
+		}
+	}
+
+	u, err := user.GetInstance(s.userName)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// as history set: every episode up to it is watched, the ones after it are not
+	if err := u.SetWatchedUpTo(provider.Name(), series, episode); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error saving the history: \n\t- %s", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u.GetHistory())
+}
+
+/*
+	Finds a series previously returned by a search or saved in the history
+*/
+func (s *Server) resolveSeries(providerName string, seriesID string) (models.Provider, models.Series, int, error) {
+	if seriesID == "" {
+		return nil, models.Series{}, http.StatusBadRequest, errors.New("missing series_id")
+	}
+
+	provider, err := models.GetProvider(providerName)
+	if provider == nil {
+		return nil, models.Series{}, http.StatusBadRequest, err
+	}
+
+	s.seriesMu.Lock()
+	series, ok := s.series[seriesKey(provider.Name(), seriesID)]
+	s.seriesMu.Unlock()
+
+	if ok {
+		return provider, series, http.StatusOK, nil
+	}
+
+	u, err := user.GetInstance(s.userName)
+	if err != nil {
+		return nil, models.Series{}, http.StatusInternalServerError, err
+	}
+
+	for _, h := range u.GetHistory() {
+		if h.SeriesID != seriesID || (h.Provider != provider.Name() && h.Provider != "") {
+			continue
+		}
+
+		return provider, h.Series(), http.StatusOK, nil
+	}
+
+	return nil, models.Series{}, http.StatusNotFound, fmt.Errorf("series %s not found, search it first", seriesID)
+}
+
+func seriesKey(provider string, seriesID string) string {
+	return provider + "/" + seriesID
+}
+
+func parseUintParam(r *http.Request, name string, fallback uint) (uint, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+
+	return uint(parsed), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
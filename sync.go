@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/httpclient"
+	"github.com/IceWizard98/series_downloader/models/queue"
+	"github.com/IceWizard98/series_downloader/models/user"
+)
+
+type syncResult struct {
+	Provider string   `json:"provider"`
+	Series   string   `json:"series"`
+	Episodes uint     `json:"episodes"`
+	Queued   []uint16 `json:"queued"`
+	Failed   []uint16 `json:"failed,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+/*
+	sync [flags] [series...]
+*/
+func runSync(args []string) error {
+	fs     := newFlagSet("sync", "[flags] [series...]", "Download the next DOWNLOAD_NEXT_EPISODES episodes of every series in the history, or only of the given ids or slugs")
+	flags  := addCommonFlags(fs)
+	dryRun  := fs.Bool("dry-run", false, "Only show the episodes that would be downloaded")
+	quality := addQualityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := applyQuality(*quality); err != nil {
+		return err
+	}
+
+	if *flags.json {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*flags.userName)
+	if err != nil {
+		return err
+	}
+
+	only := make(map[string]bool, fs.NArg())
+	for _, arg := range fs.Args() {
+		only[arg] = true
+	}
+
+	nextNEpisodes := nextEpisodesSetting()
+	if nextNEpisodes == 0 {
+		return errors.New("DOWNLOAD_NEXT_EPISODES is 0, nothing to sync")
+	}
+
+	q, err  := openQueue(u.RootDir, nil)
+	if err != nil {
+		return err
+	}
+
+	results := []*syncResult{}
+	jobs    := map[uint64]*syncResult{}
+
+	for _, h := range u.GetHistory() {
+		if len(only) > 0 && !only[h.SeriesID] && !only[h.SeriesSlug] {
+			continue
+		}
+
+		series := h.Series()
+		result := &syncResult{Provider: h.Provider, Series: series.Slug}
+		results = append(results, result)
+
+		provider, err := models.GetProvider(h.Provider)
+		if provider == nil {
+			fmt.Printf("⚠️ %s: %s\n", series.Name, err)
+			result.Error = err.Error()
+			continue
+		}
+
+		// the total grows while a series is airing, refresh it before asking the episodes.
+		// The cached responses are revalidated, or a new episode would show up only after CACHE_TTL
+		ctx := httpclient.WithRevalidate(appContext())
+		if found, err := provider.Search(ctx, series.Name); err == nil {
+			for _, s := range found {
+				if s.ID != series.ID {
+					continue
+				}
+
+				series.Name, series.Slug, series.Episodes = s.Name, s.Slug, s.Episodes
+				if _, err := u.UpdateSeries(provider.Name(), series); err != nil {
+					fmt.Printf("⚠️ Error updating history of %s: \n\t- %s\n", series.Name, err)
+				}
+				break
+			}
+		} else {
+			fmt.Printf("⚠️ Error refreshing %s, using saved data: \n\t- %s\n", series.Name, err)
+		}
+
+		result.Series   = series.Slug
+		result.Episodes = series.Episodes
+
+		// the next unwatched episodes, a skipped one included
+		start := uint(h.NextUnwatched())
+		end   := unwatchedEnd(h.NextUnwatched() - 1, nextNEpisodes, h.IsWatched)
+		if start > series.Episodes {
+			fmt.Printf("✅ %s is up to date\n", series.Name)
+			continue
+		}
+
+		episodes, err := provider.GetEpisodes(ctx, series, start, end)
+		if err != nil {
+			fmt.Printf("⚠️ Error retriving episodes of %s: \n\t- %s\n", series.Name, err)
+			result.Error = err.Error()
+			continue
+		}
+
+		onDisk := episodesOnDisk(u.RootDir, provider.Name(), series)
+		for _, episode := range episodes {
+			if uint(episode.Number) < start || uint(episode.Number) > end {
+				continue
+			}
+
+			if _, ok := onDisk(episode); ok || h.IsWatched(episode.Number) {
+				continue
+			}
+
+			result.Queued = append(result.Queued, episode.Number)
+			if *dryRun {
+				continue
+			}
+
+			job := q.Enqueue(provider.Name(), series, episode)
+			jobs[job.ID] = result
+		}
+
+		fmt.Printf("🔄 %s: %d episodes to download %v\n", series.Name, len(result.Queued), result.Queued)
+	}
+
+	q.Wait()
+
+	failed := 0
+	for _, job := range q.List() {
+		result, ok := jobs[job.ID]
+		if !ok {
+			continue
+		}
+
+		if job.State == queue.STATE_FAILED {
+			result.Failed = append(result.Failed, job.Episode.Number)
+			failed++
+		}
+	}
+
+	if *flags.json {
+		printJSON(results)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d episodes failed", failed)
+	}
+
+	return nil
+}
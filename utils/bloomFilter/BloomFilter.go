@@ -1,35 +1,215 @@
 package bloomfilter
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+
 	"github.com/cespare/xxhash/v2"
 )
 
-var instance *bloomFilter
+const (
+	DEFAULT_EXPECTED_ITEMS      = 10000
+	DEFAULT_FALSE_POSITIVE_RATE = 0.01
+	FILTER_FILE                 = "/.bloom"
+	MAX_HASHES                  = 64
+)
+
+var fileMagic = []byte("BLM1")
+
+var (
+	instance   *bloomFilter
+	instanceMu sync.Mutex
+)
+
+/*
+	Bloom filter safe for concurrent use
+*/
 type bloomFilter struct{
-	k      uint32
-	Filter uint32
+	mu   sync.RWMutex
+	k    uint32
+	m    uint64
+	bits []uint64
+	path string
 }
 
+/*
+	Returns the shared filter, a default sized one if none was set with SetInstance
+*/
 func GetInstance() *bloomFilter {
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
 	if instance == nil {
-		instance = &bloomFilter{
-			k:      3,
-			Filter: 0,
-		}
+		instance = New(DEFAULT_EXPECTED_ITEMS, DEFAULT_FALSE_POSITIVE_RATE)
 	}
 
 	return instance
 }
 
-func (b *bloomFilter) getHashes(value []byte) []uint32 {
-	hashes := make([]uint32, b.k)
+func SetInstance(filter *bloomFilter) {
+	instanceMu.Lock()
+	defer instanceMu.Unlock()
+
+	instance = filter
+}
+
+/*
+	Creates a filter sized to hold expectedItems with the given false positive rate
+*/
+func New(expectedItems uint, falsePositiveRate float64) *bloomFilter {
+	m, k := OptimalSize(expectedItems, falsePositiveRate)
+	return NewWithSize(m, k)
+}
+
+/*
+	Creates a filter of m bits using k hashes, at most MAX_HASHES
+*/
+func NewWithSize(m uint64, k uint32) *bloomFilter {
+	if m == 0 {
+		m = 64
+	}
+
+	// more hashes only fill the filter faster, and Load refuses them
+	k = min(max(k, 1), MAX_HASHES)
+
+	return &bloomFilter{
+		k:    k,
+		m:    m,
+		bits: make([]uint64, (m+63)/64),
+	}
+}
+
+/*
+	Returns bits and hashes needed to hold n items with a false positive rate p:
+	m = -n*ln(p) / ln(2)^2, k = m/n * ln(2)
+*/
+func OptimalSize(n uint, p float64) (uint64, uint32) {
+	if n == 0 {
+		n = DEFAULT_EXPECTED_ITEMS
+	}
+
+	if p <= 0 || p >= 1 {
+		p = DEFAULT_FALSE_POSITIVE_RATE
+	}
+
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+
+	return uint64(m), uint32(min(max(k, 1), MAX_HASHES))
+}
+
+/*
+	Loads a filter saved with Save, later saves go to the same path
+*/
+func Load(path string) (*bloomFilter, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bytes.NewReader(content)
+
+	magic := make([]byte, len(fileMagic))
+	if _, err := reader.Read(magic); err != nil || !bytes.Equal(magic, fileMagic) {
+		return nil, fmt.Errorf("%s is not a bloom filter file", path)
+	}
+
+	var k uint32
+	var m uint64
+	if err := binary.Read(reader, binary.LittleEndian, &k); err != nil {
+		return nil, fmt.Errorf("error reading %s: \n\t- %s", path, err)
+	}
+
+	if err := binary.Read(reader, binary.LittleEndian, &m); err != nil {
+		return nil, fmt.Errorf("error reading %s: \n\t- %s", path, err)
+	}
+
+	// a corrupted header could ask for any size, check it against the file before allocating,
+	// m is bounded first so m+63 can't overflow
+	remaining := uint64(reader.Len())
+	if m == 0 || k == 0 || k > MAX_HASHES || m > remaining*8 || (m+63)/64*8 != remaining {
+		return nil, fmt.Errorf("%s has an invalid size", path)
+	}
+
+	filter := NewWithSize(m, k)
+
+	if err := binary.Read(reader, binary.LittleEndian, filter.bits); err != nil {
+		return nil, fmt.Errorf("error reading %s: \n\t- %s", path, err)
+	}
+
+	filter.path = path
+	return filter, nil
+}
+
+/*
+	Writes the filter to path, or to the path it was loaded from when empty
+*/
+func (b *bloomFilter) Save(path string) error {
+	// the write lock also serializes concurrent saves on the same temporary file
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if path == "" {
+		path = b.path
+	}
+
+	if path == "" {
+		return errors.New("bloom filter has no path to save to")
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, len(fileMagic)+12+len(b.bits)*8))
+	buffer.Write(fileMagic)
+	_ = binary.Write(buffer, binary.LittleEndian, b.k)
+	_ = binary.Write(buffer, binary.LittleEndian, b.m)
+	_ = binary.Write(buffer, binary.LittleEndian, b.bits)
+
+	// write and rename, so a crash never leaves a truncated filter
+	if err := os.WriteFile(path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	b.path = path
+	return nil
+}
+
+/*
+	Returns bits and hashes of the filter
+*/
+func (b *bloomFilter) Size() (uint64, uint32) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.m, b.k
+}
+
+/*
+	Empties the filter
+*/
+func (b *bloomFilter) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	clear(b.bits)
+}
+
+func (b *bloomFilter) getHashes(value []byte) []uint64 {
+	hashes := make([]uint64, b.k)
 	hash   := xxhash.Sum64(value)
-	h1     := uint32(hash & 0xFFFFFFFF)
-	h2     := uint32((hash >> 32) & 0xFFFFFFFF)
+	h1     := hash & 0xFFFFFFFF
+	h2     := (hash >> 32) & 0xFFFFFFFF
 
-	for i := range b.k {
+	for i := range uint64(b.k) {
 		generated := h1 + h2*i
-		hashes[i]  = uint32(generated % 32)
+		hashes[i]  = generated % b.m
 	}
 
 	return hashes
@@ -37,15 +217,23 @@ func (b *bloomFilter) getHashes(value []byte) []uint32 {
 
 func (b *bloomFilter) Add(value []byte) {
 	hashes := b.getHashes(value)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	for _, hash := range hashes {
-		b.Filter |= 1 << hash
+		b.bits[hash/64] |= 1 << (hash % 64)
 	}
 }
 
 func (b *bloomFilter) Contains(value []byte) bool {
 	hashes := b.getHashes(value)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	for _, hash := range hashes {
-		if (b.Filter & (1 << hash)) == 0 {
+		if (b.bits[hash/64] & (1 << (hash % 64))) == 0 {
 			return false
 		}
 	}
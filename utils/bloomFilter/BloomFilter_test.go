@@ -0,0 +1,140 @@
+package bloomfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const (
+	TEST_GOROUTINES = 16
+	TEST_VALUES     = 500
+)
+
+func testValue(goroutine int, i int) []byte {
+	return []byte(fmt.Sprintf("animeunity/series-%d/episode-%d", goroutine, i))
+}
+
+/*
+	Adds and looks up values from many goroutines, run it with -race
+*/
+func TestConcurrentAddContains(t *testing.T) {
+	filter := New(TEST_GOROUTINES*TEST_VALUES, DEFAULT_FALSE_POSITIVE_RATE)
+
+	var wg sync.WaitGroup
+	for g := range TEST_GOROUTINES {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range TEST_VALUES {
+				filter.Add(testValue(g, i))
+				if !filter.Contains(testValue(g, i)) {
+					t.Errorf("value %d of goroutine %d not found right after Add", i, g)
+				}
+
+				// look up what the other goroutines are writing
+				filter.Contains(testValue((g+1)%TEST_GOROUTINES, i))
+			}
+		}()
+	}
+	wg.Wait()
+
+	for g := range TEST_GOROUTINES {
+		for i := range TEST_VALUES {
+			if !filter.Contains(testValue(g, i)) {
+				t.Fatalf("value %d of goroutine %d not found", i, g)
+			}
+		}
+	}
+}
+
+/*
+	Saves the filter while other goroutines add to it, the loaded copy must be readable
+*/
+func TestConcurrentSave(t *testing.T) {
+	filter := New(TEST_GOROUTINES*TEST_VALUES, DEFAULT_FALSE_POSITIVE_RATE)
+	path   := filepath.Join(t.TempDir(), FILTER_FILE)
+
+	var wg sync.WaitGroup
+	for g := range TEST_GOROUTINES {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range TEST_VALUES {
+				filter.Add(testValue(g, i))
+				if i%100 == 0 {
+					if err := filter.Save(path); err != nil {
+						t.Errorf("error saving the filter: %s", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := filter.Save(""); err != nil {
+		t.Fatalf("error saving the filter: %s", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("error loading the filter: %s", err)
+	}
+
+	if m, k := loaded.Size(); m != filter.m || k != filter.k {
+		t.Fatalf("loaded size %d/%d, saved %d/%d", m, k, filter.m, filter.k)
+	}
+
+	for g := range TEST_GOROUTINES {
+		for i := range TEST_VALUES {
+			if !loaded.Contains(testValue(g, i)) {
+				t.Fatalf("value %d of goroutine %d not found after Load", i, g)
+			}
+		}
+	}
+}
+
+/*
+	A damaged file is refused before the size in its header is allocated
+*/
+func TestLoadInvalidSize(t *testing.T) {
+	header := func(k uint32, m uint64) []byte {
+		content := append([]byte{}, fileMagic...)
+		content  = binary.LittleEndian.AppendUint32(content, k)
+		return binary.LittleEndian.AppendUint64(content, m)
+	}
+
+	for name, content := range map[string][]byte{
+		"huge size":        header(7, math.MaxUint64),
+		"truncated bits":   append(header(7, 1024), make([]byte, 64)...),
+		"extra bits":       append(header(7, 64), make([]byte, 16)...),
+		"no hashes":        append(header(0, 64), make([]byte, 8)...),
+		"too many hashes":  append(header(MAX_HASHES+1, 64), make([]byte, 8)...),
+		"truncated header": fileMagic,
+		"other file":       []byte("#EXTM3U"),
+	} {
+		path := filepath.Join(t.TempDir(), FILTER_FILE)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), FILTER_FILE)
+	if err := os.WriteFile(path, append(header(7, 100), make([]byte, 16)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(path); err != nil {
+		t.Errorf("valid file: %s", err)
+	}
+}
@@ -0,0 +1,38 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrLocked = errors.New("locked by another process")
+
+/*
+	Exclusive lock on a file, shared between processes.
+	The system releases it when the process exits, even when it's killed,
+	so a crash never leaves it held
+*/
+type FileLock struct {
+	file *os.File
+}
+
+/*
+	Takes the lock on path, creating the file, waits until other processes release it
+*/
+func Lock(path string) (*FileLock, error) {
+	return lock(path, true)
+}
+
+/*
+	Like Lock but returns ErrLocked instead of waiting
+*/
+func TryLock(path string) (*FileLock, error) {
+	return lock(path, false)
+}
+
+/*
+	Releases the lock, the file is kept
+*/
+func (l *FileLock) Unlock() error {
+	return l.file.Close()
+}
@@ -0,0 +1,41 @@
+package filelock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	ERROR_SHARING_VIOLATION syscall.Errno = 32
+	// how often Lock tries again to open a file held by another process
+	RETRY_INTERVAL = 50 * time.Millisecond
+)
+
+/*
+	A file opened without sharing can't be opened again until it's closed,
+	that is the lock
+*/
+func lock(path string, wait bool) (*FileLock, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+		if err == nil {
+			return &FileLock{file: os.NewFile(uintptr(handle), path)}, nil
+		}
+
+		if !errors.Is(err, ERROR_SHARING_VIOLATION) {
+			return nil, err
+		}
+		if !wait {
+			return nil, ErrLocked
+		}
+
+		time.Sleep(RETRY_INTERVAL)
+	}
+}
@@ -0,0 +1,389 @@
+package fuzzyselect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	LIST_HEIGHT    = 10
+	PREVIEW_HEIGHT = 5
+	DEFAULT_WIDTH  = 80
+)
+
+var ErrCancelled = errors.New("selection cancelled")
+
+/*
+	An entry of the list: Label is shown and matched against the filter,
+	Preview is shown below the list while the entry is highlighted
+*/
+type Item struct {
+	Label   string
+	Preview []string
+}
+
+/*
+	The choice: Index is the position of the selected item, -1 when the
+	filter matches nothing, and Query is what was typed
+*/
+type Result struct {
+	Index int
+	Query string
+}
+
+type selector struct {
+	prompt  string
+	items   []Item
+	query   []rune
+	matches []int
+	cursor  int
+	offset  int
+	width   int
+	drawn   int
+	out     io.Writer
+}
+
+/*
+	True when stdin and stdout are terminals that can be put in raw mode with stty,
+	otherwise the caller should fall back to a numbered prompt
+*/
+func Available() bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+
+	if _, err := exec.LookPath("stty"); err != nil {
+		return false
+	}
+
+	return isTerminal(os.Stdin) && isTerminal(os.Stdout)
+}
+
+/*
+	Shows items in a list filtered while typing, moved with the arrow keys and
+	chosen with Enter. Esc and Ctrl+C return ErrCancelled
+*/
+func Select(prompt string, items []Item) (Result, error) {
+	restore, err := rawMode()
+	if err != nil {
+		return Result{Index: -1}, fmt.Errorf("error setting the terminal in raw mode: \n\t- %s", err)
+	}
+	defer restore()
+
+	s := &selector{
+		prompt: prompt,
+		items:  items,
+		width:  terminalWidth(),
+		out:    os.Stdout,
+	}
+	s.filter()
+
+	fmt.Fprint(s.out, "\x1b[?25l")
+	defer fmt.Fprint(s.out, "\x1b[?25h")
+
+	buf := make([]byte, 64)
+	for {
+		s.draw()
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			s.clear()
+			return Result{Index: -1}, err
+		}
+
+		// the escape sequences of the special keys come in a single read
+		if buf[0] == 0x1b {
+			switch string(buf[:n]) {
+			case "\x1b":
+				s.clear()
+				return Result{Index: -1, Query: string(s.query)}, ErrCancelled
+			case "\x1b[A", "\x1bOA":
+				s.move(-1)
+			case "\x1b[B", "\x1bOB":
+				s.move(1)
+			case "\x1b[5~":
+				s.move(-LIST_HEIGHT)
+			case "\x1b[6~":
+				s.move(LIST_HEIGHT)
+			}
+			continue
+		}
+
+		// anything else is typed, or pasted, one character at a time
+		query := string(s.query)
+		for _, r := range string(buf[:n]) {
+			switch r {
+			case 0x03:
+				s.clear()
+				return Result{Index: -1, Query: string(s.query)}, ErrCancelled
+
+			case '\r', '\n':
+				if string(s.query) != query {
+					s.filter()
+				}
+				return s.choose(), nil
+
+			case 0x10:
+				s.move(-1)
+
+			case 0x0e:
+				s.move(1)
+
+			case 0x7f, 0x08:
+				if len(s.query) > 0 {
+					s.query = s.query[:len(s.query)-1]
+				}
+
+			case 0x15:
+				s.query = s.query[:0]
+
+			default:
+				if unicode.IsPrint(r) {
+					s.query = append(s.query, r)
+				}
+			}
+		}
+
+		if string(s.query) != query {
+			s.filter()
+		}
+	}
+}
+
+/*
+	Returns the highlighted item and replaces the selector with it
+*/
+func (s *selector) choose() Result {
+	result := Result{Index: -1, Query: string(s.query)}
+	if len(s.matches) > 0 {
+		result.Index = s.matches[s.cursor]
+	}
+
+	s.clear()
+	if result.Index >= 0 {
+		fmt.Fprintf(s.out, "%s: %s\n", s.prompt, s.items[result.Index].Label)
+	}
+
+	return result
+}
+
+/*
+	Keeps the items matching the query, the best matches first
+*/
+func (s *selector) filter() {
+	type match struct {
+		index int
+		score int
+	}
+
+	query   := strings.ToLower(string(s.query))
+	matched := []match{}
+
+	for i, item := range s.items {
+		if score, ok := fuzzyScore(strings.ToLower(item.Label), query); ok {
+			matched = append(matched, match{i, score})
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].score < matched[j].score })
+
+	s.matches = s.matches[:0]
+	for _, m := range matched {
+		s.matches = append(s.matches, m.index)
+	}
+
+	s.cursor = 0
+	s.offset = 0
+}
+
+func (s *selector) move(delta int) {
+	if len(s.matches) == 0 {
+		return
+	}
+
+	s.cursor = min(max(s.cursor + delta, 0), len(s.matches) - 1)
+
+	if s.cursor < s.offset {
+		s.offset = s.cursor
+	}
+	if s.cursor >= s.offset + LIST_HEIGHT {
+		s.offset = s.cursor - LIST_HEIGHT + 1
+	}
+}
+
+/*
+	Redraws the prompt, the visible part of the list and the preview over the previous frame
+*/
+func (s *selector) draw() {
+	lines := []string{fmt.Sprintf("%s (%d/%d, Esc to cancel)", s.prompt, len(s.matches), len(s.items)), "> " + string(s.query)}
+
+	for row := range LIST_HEIGHT {
+		i := s.offset + row
+		switch {
+		case i >= len(s.matches):
+			lines = append(lines, "")
+		case i == s.cursor:
+			lines = append(lines, "\x1b[7m▸ " + s.items[s.matches[i]].Label + "\x1b[0m")
+		default:
+			lines = append(lines, "  " + s.items[s.matches[i]].Label)
+		}
+	}
+
+	lines = append(lines, strings.Repeat("─", min(s.width, 40)))
+
+	var preview []string
+	if len(s.matches) > 0 {
+		preview = s.items[s.matches[s.cursor]].Preview
+	} else {
+		preview = []string{"No matches"}
+	}
+
+	for row := range PREVIEW_HEIGHT {
+		if row < len(preview) {
+			lines = append(lines, preview[row])
+		} else {
+			lines = append(lines, "")
+		}
+	}
+
+	s.clear()
+	for _, line := range lines {
+		fmt.Fprintf(s.out, "%s\x1b[K\n", truncate(line, s.width))
+	}
+	s.drawn = len(lines)
+}
+
+/*
+	Moves back to the first line of the frame and erases it
+*/
+func (s *selector) clear() {
+	if s.drawn > 0 {
+		fmt.Fprintf(s.out, "\x1b[%dA", s.drawn)
+	}
+	fmt.Fprint(s.out, "\r\x1b[J")
+	s.drawn = 0
+}
+
+/*
+	Returns whether every character of query appears in label in order and how
+	good the match is, lower is better: a match starting early and with the
+	characters close to each other comes first
+*/
+func fuzzyScore(label string, query string) (int, bool) {
+	if query == "" {
+		return 0, true
+	}
+
+	// a substring is always better than a scattered match
+	if start := strings.Index(label, query); start >= 0 {
+		return start, true
+	}
+
+	// the first skip is where the match starts, the others the gaps between the characters
+	score := len(label)
+	pos   := 0
+
+	for _, r := range query {
+		next := strings.IndexRune(label[pos:], r)
+		if next < 0 {
+			return 0, false
+		}
+
+		score += next
+		pos   += next + utf8.RuneLen(r)
+	}
+
+	return score, true
+}
+
+/*
+	Cuts line to width visible characters, the escape sequences don't count
+*/
+func truncate(line string, width int) string {
+	visible := 0
+	escape  := false
+
+	for i, r := range line {
+		switch {
+		case r == 0x1b:
+			escape = true
+		case escape:
+			if unicode.IsLetter(r) {
+				escape = false
+			}
+		default:
+			visible++
+			if visible > width {
+				return line[:i] + "\x1b[0m"
+			}
+		}
+	}
+
+	return line
+}
+
+/*
+	Disables the line buffering and the echo of the terminal with stty and returns the
+	function that restores the previous settings. Ctrl+C is read as a key, so the terminal
+	is never left in raw mode by the interrupt handler
+*/
+func rawMode() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1", "time", "0"); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if _, err := stty(strings.TrimSpace(saved)); err != nil {
+			fmt.Printf("⚠️ Error restoring the terminal, run stty sane: \n\t- %s\n", err)
+		}
+	}, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd      := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+/*
+	Returns the columns of the terminal, DEFAULT_WIDTH when stty can't tell
+*/
+func terminalWidth() int {
+	size, err := stty("size")
+	if err != nil {
+		return DEFAULT_WIDTH
+	}
+
+	fields := strings.Fields(size)
+	if len(fields) != 2 {
+		return DEFAULT_WIDTH
+	}
+
+	cols, err := strconv.Atoi(fields[1])
+	if err != nil || cols <= 0 {
+		return DEFAULT_WIDTH
+	}
+
+	return cols
+}
+
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
@@ -9,7 +9,9 @@ type IceRoutinePool struct {
 	Name string
 	Closed bool
 
+	mu sync.RWMutex
 	jobs chan func()
+	senders sync.WaitGroup
 	wg *sync.WaitGroup
 	ctx context.Context	
 	ctxCancel context.CancelFunc	
@@ -47,19 +49,12 @@ func New(name string, ctx context.Context, bufferSize uint, concurrentJobs uint)
 
 	for range concurrentJobs {
 		go func() {
-			for {
-				select {
-				case <-instance.ctx.Done():
-					return
-
-				case task, ok := <-instance.jobs:
-					if !ok {
-						return
-					}
-
+			// once the context is cancelled the queued tasks are skipped
+			for task := range instance.jobs {
+				if instance.ctx.Err() == nil {
 					task()
-					instance.wg.Done()
 				}
+				instance.wg.Done()
 			}
 		}()
 	}
@@ -67,15 +62,26 @@ func New(name string, ctx context.Context, bufferSize uint, concurrentJobs uint)
 	return instance
 }
 
+/*
+	Returns the context of the pool, cancelled by Cancel, CancelAll or the parent context
+*/
+func (i *IceRoutinePool) Context() context.Context {
+	return i.ctx
+}
+
 func (i *IceRoutinePool) AddSubGroup(name string, bufferSize uint, concurrentJobs uint) *IceRoutinePool {
 	existing := i.GetSubGroup([]string{name})
 
-	if existing != nil && !existing.Closed{
+	if existing != nil && !existing.isClosed() {
 		return existing
 	}
 
 	subGroup := New(name, i.ctx, bufferSize, concurrentJobs)
+
+	i.mu.Lock()
 	i.subGroups[name] = subGroup
+	i.mu.Unlock()
+
 	return subGroup
 }
 
@@ -85,7 +91,9 @@ func (i *IceRoutinePool) GetSubGroup(name []string) *IceRoutinePool {
 		return i
 	}
 
+	i.mu.RLock()
 	subGroup, ok := i.subGroups[name[0]]
+	i.mu.RUnlock()
 
 	if !ok {
 		return nil
@@ -98,19 +106,38 @@ func (i *IceRoutinePool) GetSubGroup(name []string) *IceRoutinePool {
 	return subGroup
 }
 
-func (i *IceRoutinePool) AddTask(task func()) {
-	// if i.Closed { return } 
+/*
+	Queues a task, it's dropped returning false when the pool is closed or cancelled.
+	A queued task is still skipped if the pool is cancelled before it starts
+*/
+func (i *IceRoutinePool) AddTask(task func()) bool {
+	i.mu.RLock()
+	if i.Closed || i.ctx.Err() != nil {
+		i.mu.RUnlock()
+		return false
+	} 
+	i.senders.Add(1)
 	i.wg.Add(1)
-	i.jobs <- task
+	i.mu.RUnlock()
+
+	defer i.senders.Done()
+
+	select {
+	case i.jobs <- task:
+		return true
+	case <-i.ctx.Done():
+		i.wg.Done()
+		return false
+	}
 }
 
 func (i *IceRoutinePool) Wait() {
-	if i.Closed { return } 
+	if i.isClosed() { return } 
 	i.wg.Wait()
 }
 
 func (i *IceRoutinePool) WaitAll() {
-	for _, sub := range i.subGroups {
+	for _, sub := range i.subGroupsList() {
 		sub.WaitAll()
 	}
 
@@ -118,35 +145,72 @@ func (i *IceRoutinePool) WaitAll() {
 }
 
 func (i *IceRoutinePool) Close() {
-	if i.Closed { return } 
-	close(i.jobs)
-	i.Wait()
-	i.Closed = true
+	if !i.markClosed() { return } 
+	i.wg.Wait()
 }
 
 func (i *IceRoutinePool) CloseAll() {
-	for _, sub := range i.subGroups {
+	for _, sub := range i.subGroupsList() {
 		sub.CloseAll()
 	}
 	
-	if i.Closed { return } 
 	i.Close()
 }
 
+/*
+	Cancels the context, so running tasks can stop, skips the queued ones and waits for them
+*/
 func (i *IceRoutinePool) Cancel() {
-	if i.Closed { return } 
-	close(i.jobs)
-	i.Wait()
 	i.ctxCancel()
-	i.Closed = true
+	if !i.markClosed() { return } 
+	i.wg.Wait()
 }
 
 func (i *IceRoutinePool) CancelAll() {
-	for nme, sub := range i.subGroups {
+	for _, sub := range i.subGroupsList() {
 		sub.CancelAll()
-		delete(i.subGroups, nme)
 	}
+
+	i.mu.Lock()
+	clear(i.subGroups)
+	i.mu.Unlock()
   
-	if i.Closed { return } 
 	i.Cancel()
 }
+
+func (i *IceRoutinePool) isClosed() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.Closed
+}
+
+/*
+	Closes the jobs channel once the pending AddTask calls are done,
+	returns false if it was already closed
+*/
+func (i *IceRoutinePool) markClosed() bool {
+	i.mu.Lock()
+	if i.Closed {
+		i.mu.Unlock()
+		return false
+	}
+	i.Closed = true
+	i.mu.Unlock()
+
+	i.senders.Wait()
+	close(i.jobs)
+	return true
+}
+
+func (i *IceRoutinePool) subGroupsList() []*IceRoutinePool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	subGroups := make([]*IceRoutinePool, 0, len(i.subGroups))
+	for _, sub := range i.subGroups {
+		subGroups = append(subGroups, sub)
+	}
+
+	return subGroups
+}
@@ -0,0 +1,265 @@
+package progressbar
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+)
+
+const (
+	BAR_WIDTH        = 30
+	REDRAW_INTERVAL  = 200 * time.Millisecond
+	LOG_INTERVAL     = 10 * time.Second
+)
+
+/*
+	Renders one live progress bar per download at the bottom of the terminal.
+	While it runs os.Stdout is replaced by a pipe, so every message printed by
+	the downloads is written above the bars instead of over them.
+	When stdout is not a terminal a progress line is printed every LOG_INTERVAL
+*/
+type Renderer struct {
+	mu       sync.Mutex
+	out      *os.File
+	tty      bool
+	bars     map[string]models.Progress
+	lastLog  map[string]time.Time
+	drawn    int
+	midLine  bool
+
+	pipeR    *os.File
+	pipeW    *os.File
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+/*
+	Starts rendering on the current os.Stdout
+*/
+func Start() *Renderer {
+	r := &Renderer{
+		out:     os.Stdout,
+		bars:    make(map[string]models.Progress),
+		lastLog: make(map[string]time.Time),
+		stop:    make(chan struct{}),
+	}
+
+	if stat, err := r.out.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		r.tty = true
+	}
+
+	if !r.tty {
+		return r
+	}
+
+	pipeR, pipeW, err := os.Pipe()
+	if err != nil {
+		r.tty = false
+		return r
+	}
+
+	r.pipeR, r.pipeW = pipeR, pipeW
+	os.Stdout        = pipeW
+
+	r.wg.Add(2)
+	go r.forward()
+	go r.redraw()
+
+	return r
+}
+
+/*
+	Updates the bar of a download, can be used as models.ProgressFunc
+*/
+func (r *Renderer) Update(progress models.Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := barKey(progress.Series, progress.Episode)
+
+	if r.tty {
+		r.bars[key] = progress
+		return
+	}
+
+	if time.Since(r.lastLog[key]) < LOG_INTERVAL {
+		return
+	}
+
+	r.lastLog[key] = time.Now()
+	fmt.Fprintf(r.out, "⬇️ %s\n", formatLine(progress))
+}
+
+/*
+	Removes the bar of a finished download
+*/
+func (r *Renderer) Done(series string, episode uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.bars, barKey(series, episode))
+	delete(r.lastLog, barKey(series, episode))
+}
+
+/*
+	Stops rendering, restores os.Stdout and removes the bars
+*/
+func (r *Renderer) Stop() {
+	if !r.tty {
+		return
+	}
+
+	os.Stdout = r.out
+	close(r.stop)
+	r.pipeW.Close()
+	r.wg.Wait()
+	r.pipeR.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.erase()
+	r.tty = false
+}
+
+/*
+	Copies what is printed on the pipe to the terminal, above the bars
+*/
+func (r *Renderer) forward() {
+	defer r.wg.Done()
+
+	buffer := make([]byte, 4096)
+	for {
+		n, err := r.pipeR.Read(buffer)
+		if n > 0 {
+			r.mu.Lock()
+			r.erase()
+			r.out.Write(buffer[:n])
+			// a prompt without new line stays on screen, the bars wait for it
+			r.midLine = buffer[n-1] != '\n'
+			r.draw()
+			r.mu.Unlock()
+		}
+
+		if err == io.EOF || err != nil {
+			return
+		}
+	}
+}
+
+func (r *Renderer) redraw() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(REDRAW_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			r.erase()
+			r.draw()
+			r.mu.Unlock()
+		}
+	}
+}
+
+/*
+	Removes the drawn bars, r.mu must be held
+*/
+func (r *Renderer) erase() {
+	if r.drawn == 0 {
+		return
+	}
+
+	r.out.WriteString(strings.Repeat("\033[1A\033[2K", r.drawn))
+	r.drawn = 0
+}
+
+/*
+	Draws the bars sorted by series and episode, r.mu must be held
+*/
+func (r *Renderer) draw() {
+	if r.midLine || len(r.bars) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(r.bars))
+	for key := range r.bars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for _, key := range keys {
+		progress := r.bars[key]
+		builder.WriteString(renderBar(progress))
+		builder.WriteString(" ")
+		builder.WriteString(formatLine(progress))
+		builder.WriteString("\n")
+	}
+
+	r.out.WriteString(builder.String())
+	r.drawn = len(keys)
+}
+
+func barKey(series string, episode uint16) string {
+	return fmt.Sprintf("%s/%05d", series, episode)
+}
+
+func renderBar(progress models.Progress) string {
+	if progress.Total <= 0 {
+		return "[" + strings.Repeat("?", BAR_WIDTH) + "]"
+	}
+
+	filled := int(float64(BAR_WIDTH) * float64(progress.Done) / float64(progress.Total))
+	filled  = min(max(filled, 0), BAR_WIDTH)
+
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", BAR_WIDTH-filled) + "]"
+}
+
+/*
+	e.g. "naruto 3: 45.2% 512.0 MB/1.1 GB 3.4 MB/s ETA 2m31s"
+*/
+func formatLine(progress models.Progress) string {
+	line := fmt.Sprintf("%s %d:", progress.Series, progress.Episode)
+
+	if progress.Total > 0 {
+		line += fmt.Sprintf(" %5.1f%% %s/%s", float64(progress.Done)*100/float64(progress.Total), FormatBytes(progress.Done), FormatBytes(progress.Total))
+	} else {
+		line += " " + FormatBytes(progress.Done)
+	}
+
+	line += fmt.Sprintf(" %s/s", FormatBytes(int64(progress.Speed)))
+
+	if progress.ETA > 0 {
+		line += " ETA " + progress.ETA.Round(time.Second).String()
+	}
+
+	return line
+}
+
+/*
+	Formats a size in bytes with a binary unit, e.g. 1.5 MB
+*/
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 4; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTP"[exp])
+}
@@ -14,26 +14,34 @@ const MAX_CONCURRENT_DOWNLOADS = "5"
 
 func GetInstance() *iceRoutinePool.IceRoutinePool {
 	if instance == nil {
-		maxConcurrentDownloads := os.Getenv("MAX_CONCURRENT_DOWNLOADS")
+		poolSize := MaxConcurrentDownloads()
+		instance  = iceRoutinePool.New( "main", nil, poolSize, poolSize )
+	}
+	return instance
+}
 
-		if maxConcurrentDownloads == "" || len(maxConcurrentDownloads) == 0 {
-			maxConcurrentDownloads = MAX_CONCURRENT_DOWNLOADS
-		}
+/*
+	Returns MAX_CONCURRENT_DOWNLOADS from the environment or its default
+*/
+func MaxConcurrentDownloads() uint {
+	maxConcurrentDownloads := os.Getenv("MAX_CONCURRENT_DOWNLOADS")
 
-		for _, char := range maxConcurrentDownloads {
-			if !unicode.IsDigit(char) {
-				fmt.Println("Only digit are allowed in MAX_CONCURRENT_DOWNLOADS")
-				maxConcurrentDownloads = MAX_CONCURRENT_DOWNLOADS
-				break
-			}
-		}
+	if maxConcurrentDownloads == "" || len(maxConcurrentDownloads) == 0 {
+		maxConcurrentDownloads = MAX_CONCURRENT_DOWNLOADS
+	}
 
-		poolSize, err := strconv.ParseUint(maxConcurrentDownloads, 10, 16)
-		if err != nil {
-			panic(err)
+	for _, char := range maxConcurrentDownloads {
+		if !unicode.IsDigit(char) {
+			fmt.Println("Only digit are allowed in MAX_CONCURRENT_DOWNLOADS")
+			maxConcurrentDownloads = MAX_CONCURRENT_DOWNLOADS
+			break
 		}
+	}
 
-		instance = iceRoutinePool.New( "main", nil, uint(poolSize), uint(poolSize) )
+	poolSize, err := strconv.ParseUint(maxConcurrentDownloads, 10, 16)
+	if err != nil {
+		panic(err)
 	}
-	return instance
+
+	return uint(poolSize)
 }
@@ -0,0 +1,192 @@
+package videocheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	TS_PACKET_SIZE = 188
+	TS_SYNC_BYTE   = 0x47
+	// packets checked at the start of an MPEG-TS file, the last one is always checked
+	TS_CHECKED_PACKETS = 100
+)
+
+/*
+	Checks that the file at path is a complete video: an MP4 whose top level boxes
+	include ftyp and moov and fit in the file, or an MPEG-TS (the HLS downloads)
+	made of whole packets. Catches the truncated downloads and the error pages
+	saved in place of the video
+*/
+func Verify(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+
+	head := make([]byte, 512)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+
+	if head[0] == TS_SYNC_BYTE {
+		if err := verifyTS(file, stat.Size()); err != nil {
+			return fmt.Errorf("%s is not a valid MPEG-TS: \n\t- %s", path, err)
+		}
+		return nil
+	}
+
+	if looksLikeText(head) {
+		return fmt.Errorf("%s is not a video but a text file, probably an error page: %q", path, firstLine(head))
+	}
+
+	if err := verifyMP4(file, stat.Size()); err != nil {
+		return fmt.Errorf("%s is not a valid MP4: \n\t- %s", path, err)
+	}
+
+	return nil
+}
+
+/*
+	Walks the top level boxes: each one starts with a 32 bit size (1 when a 64 bit
+	size follows the type, 0 when it lasts until the end of the file) and a 4 letter type
+*/
+func verifyMP4(file io.ReaderAt, size int64) error {
+	seen   := map[string]bool{}
+	header := make([]byte, 16)
+
+	for offset := int64(0); offset < size; {
+		if size - offset < 8 {
+			return fmt.Errorf("truncated box header at byte %d", offset)
+		}
+
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return err
+		}
+
+		boxSize    := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType    := string(header[4:8])
+		headerSize := int64(8)
+
+		if !isBoxType(header[4:8]) {
+			return fmt.Errorf("invalid box type %q at byte %d", boxType, offset)
+		}
+
+		switch boxSize {
+		case 0:
+			boxSize = size - offset
+		case 1:
+			if size - offset < 16 {
+				return fmt.Errorf("truncated box header at byte %d", offset)
+			}
+			if _, err := file.ReadAt(header[8:16], offset + 8); err != nil {
+				return err
+			}
+			boxSize    = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+
+		if boxSize < headerSize {
+			return fmt.Errorf("invalid size %d of box %s at byte %d", boxSize, boxType, offset)
+		}
+
+		if offset + boxSize > size {
+			return fmt.Errorf("truncated file: box %s at byte %d needs %d bytes, %d left", boxType, offset, boxSize, size - offset)
+		}
+
+		if offset == 0 && boxType != "ftyp" {
+			return fmt.Errorf("the first box is %s instead of ftyp", boxType)
+		}
+
+		seen[boxType] = true
+		offset       += boxSize
+	}
+
+	if !seen["moov"] {
+		return fmt.Errorf("no moov box, the file was not finalized")
+	}
+
+	return nil
+}
+
+func verifyTS(file io.ReaderAt, size int64) error {
+	if size % TS_PACKET_SIZE != 0 {
+		return fmt.Errorf("truncated file: %d bytes are not whole %d byte packets", size, TS_PACKET_SIZE)
+	}
+
+	packets := size / TS_PACKET_SIZE
+	checked := []int64{packets - 1}
+	for i := range min(packets, TS_CHECKED_PACKETS) {
+		checked = append(checked, i)
+	}
+
+	sync := make([]byte, 1)
+	for _, packet := range checked {
+		if _, err := file.ReadAt(sync, packet * TS_PACKET_SIZE); err != nil {
+			return err
+		}
+
+		if sync[0] != TS_SYNC_BYTE {
+			return fmt.Errorf("no sync byte in packet %d", packet)
+		}
+	}
+
+	return nil
+}
+
+func isBoxType(boxType []byte) bool {
+	for _, c := range boxType {
+		// printable ASCII, © is used by some metadata boxes
+		if (c < 0x20 || c > 0x7e) && c != 0xa9 {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+	HTML, JSON or plain text: no control characters in the first bytes
+*/
+func looksLikeText(head []byte) bool {
+	trimmed := bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf")
+	if len(trimmed) == 0 {
+		return true
+	}
+
+	if trimmed[0] == '<' || trimmed[0] == '{' || trimmed[0] == '[' {
+		return true
+	}
+
+	for _, c := range head {
+		if c < 0x20 && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func firstLine(head []byte) string {
+	line, _, _ := bytes.Cut(bytes.TrimSpace(head), []byte("\n"))
+	if len(line) > 60 {
+		line = line[:60]
+	}
+
+	return string(line)
+}
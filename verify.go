@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/library"
+	"github.com/IceWizard98/series_downloader/models/queue"
+	"github.com/IceWizard98/series_downloader/models/user"
+	progressbar "github.com/IceWizard98/series_downloader/utils/progressBar"
+)
+
+type verifyResult struct {
+	Provider string `json:"provider"`
+	Series   string `json:"series"`
+	Episode  uint16 `json:"episode"`
+	Path     string `json:"path"`
+	Error    string `json:"error"`
+	Fixed    bool   `json:"fixed"`
+}
+
+type verifyOutput struct {
+	Checked int            `json:"checked"`
+	Bad     []verifyResult `json:"bad"`
+}
+
+/*
+	verify [flags] [series...]
+*/
+func runVerify(args []string) error {
+	fs       := newFlagSet("verify", "[flags] [series...]", "Check the episodes in the library, or only of the given ids or slugs, and report the missing, truncated or invalid files")
+	flags    := addCommonFlags(fs)
+	checksum := fs.Bool("checksum", false, "Also compare the sha256 of every file with the one saved when it was downloaded, reads every file entirely")
+	requeue  := fs.Bool("requeue", false, "Delete the bad files and download them again")
+	quality  := addQualityFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := applyQuality(*quality); err != nil {
+		return err
+	}
+
+	if *flags.json {
+		enableJSON()
+	}
+
+	u, err := user.GetInstance(*flags.userName)
+	if err != nil {
+		return err
+	}
+
+	only := make(map[string]bool, fs.NArg())
+	for _, arg := range fs.Args() {
+		only[arg] = true
+	}
+
+	lib    := library.GetInstance(u.RootDir)
+	output := verifyOutput{Bad: []verifyResult{}}
+	bad    := []library.Entry{}
+
+	for _, entry := range lib.Episodes("", "") {
+		if len(only) > 0 && !only[entry.SeriesID] && !only[entry.SeriesSlug] {
+			continue
+		}
+
+		if appContext().Err() != nil {
+			break
+		}
+
+		output.Checked++
+		if err := entry.Verify(*checksum); err != nil {
+			fmt.Printf("❌ %s episode %d: \n\t- %s\n", entry.SeriesName, entry.Number, err)
+			bad = append(bad, entry)
+			output.Bad = append(output.Bad, verifyResult{
+				Provider: entry.Provider,
+				Series:   entry.SeriesSlug,
+				Episode:  entry.Number,
+				Path:     entry.Path,
+				Error:    err.Error(),
+			})
+		}
+	}
+
+	if *requeue && len(bad) > 0 {
+		followed := map[string]models.Series{}
+		for _, h := range u.GetHistory() {
+			followed[h.Provider + "/" + h.Series().ID] = h.Series()
+		}
+
+		fixed := requeueEntries(u.RootDir, lib, bad, followed)
+		for i := range output.Bad {
+			output.Bad[i].Fixed = fixed[i]
+		}
+	}
+
+	damaged := 0
+	for _, result := range output.Bad {
+		if !result.Fixed {
+			damaged++
+		}
+	}
+
+	if *flags.json {
+		printJSON(output)
+	} else if len(output.Bad) == 0 {
+		fmt.Printf("✅ %d episodes checked, no problems found\n", output.Checked)
+	} else if damaged == 0 {
+		fmt.Printf("✅ %d episodes checked, %d downloaded again\n", output.Checked, len(output.Bad))
+	} else if !*requeue {
+		fmt.Println("Run verify --requeue to download them again")
+	}
+
+	if damaged > 0 {
+		return fmt.Errorf("%d of %d episodes are damaged", damaged, output.Checked)
+	}
+
+	return nil
+}
+
+/*
+	Deletes the files of the bad entries and downloads them again through the queue,
+	returns which of them were downloaded
+*/
+func requeueEntries(rootDir string, lib *library.Library, bad []library.Entry, followed map[string]models.Series) []bool {
+	fixed   := make([]bool, len(bad))
+	jobs    := make(map[int]uint64, len(bad))
+	deleted := []string{}
+
+	bars   := progressbar.Start()
+	q, err := openQueue(rootDir, bars)
+	if err != nil {
+		bars.Stop()
+		fmt.Printf("⚠️ Error downloading the damaged episodes again: \n\t- %s\n", err)
+		return fixed
+	}
+
+	for i, entry := range bad {
+		series, ok := followed[entry.Provider + "/" + entry.SeriesID]
+		if !ok {
+			series = models.Series{ID: entry.SeriesID, Name: entry.SeriesName, Slug: entry.SeriesSlug}
+		}
+
+		episode, series, err := entryEpisode(entry, series)
+		followed[entry.Provider + "/" + entry.SeriesID] = series
+		if err != nil {
+			fmt.Printf("⚠️ Error finding %s episode %d to download it again: \n\t- %s\n", entry.SeriesName, entry.Number, err)
+			continue
+		}
+
+		if err := os.RemoveAll(entry.Path); err != nil {
+			fmt.Printf("⚠️ Error deleting file %s: \n\t- %s\n", entry.Path, err)
+			continue
+		}
+		deleted = append(deleted, entry.Path)
+
+		fmt.Printf("🔄 Downloading again %s episode %d\n", entry.SeriesName, entry.Number)
+		jobs[i] = q.Enqueue(entry.Provider, series, episode).ID
+	}
+
+	if err := lib.Remove(deleted...); err != nil {
+		fmt.Printf("⚠️ Error updating the library: \n\t- %s\n", err)
+	}
+
+	// a bloom filter can't forget a value, rebuild it without the deleted files
+	if len(deleted) > 0 {
+		user.RebuildFilter(rootDir)
+	}
+
+	q.Wait()
+	bars.Stop()
+
+	for i, id := range jobs {
+		if job, ok := q.Get(id); ok && job.State == queue.STATE_DONE {
+			fixed[i] = true
+		}
+	}
+
+	return fixed
+}
+
+/*
+	Returns the episode of an entry with its id, looked up on the provider
+	for the entries indexed by library scan which only know the number,
+	and series as found on the provider
+*/
+func entryEpisode(entry library.Entry, series models.Series) (models.Episode, models.Series, error) {
+	episode := models.Episode{ID: entry.EpisodeID, Number: entry.Number}
+	if episode.ID != 0 {
+		return episode, series, nil
+	}
+
+	provider, err := models.GetProvider(entry.Provider)
+	if provider == nil {
+		return episode, series, err
+	}
+
+	// the provider needs the episode count, the series of the library doesn't have it
+	if series.Episodes == 0 {
+		found, err := provider.Search(appContext(), series.Name)
+		if err != nil {
+			return episode, series, err
+		}
+
+		for _, s := range found {
+			if s.ID == series.ID {
+				series = s
+				break
+			}
+		}
+	}
+
+	episodes, err := provider.GetEpisodes(appContext(), series, uint(entry.Number), uint(entry.Number))
+	if err != nil {
+		return episode, series, err
+	}
+
+	for _, e := range episodes {
+		if e.Number == entry.Number {
+			return e, series, nil
+		}
+	}
+
+	return episode, series, fmt.Errorf("episode %d of %s not found on %s", entry.Number, series.Name, provider.Name())
+}
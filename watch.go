@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/IceWizard98/series_downloader/models"
+	"github.com/IceWizard98/series_downloader/models/hooks"
+	"github.com/IceWizard98/series_downloader/models/library"
+	"github.com/IceWizard98/series_downloader/models/player"
+	"github.com/IceWizard98/series_downloader/models/user"
+	"github.com/IceWizard98/series_downloader/server"
+	progressbar "github.com/IceWizard98/series_downloader/utils/progressBar"
+	"github.com/IceWizard98/series_downloader/utils/routinepoll"
+	videocheck "github.com/IceWizard98/series_downloader/utils/videoCheck"
+)
+
+/*
+	The default command: search or pick a series from the history,
+	play the selected episode and download the next ones
+*/
+func runWatch(args []string) error {
+	fs := newFlagSet("watch", "[--title <title> | --list] [flags]", "Search a series or pick one from the history, play an episode and download the next ones")
+
+	series_title := fs.String("title", "", "Series title")
+	userName     := fs.String("user", "", "User.env file for configuration loading")
+	delete_prev  := fs.Bool("delete", false, "Delete previus episodes")
+	list         := fs.Bool("list", false, "Show list of following series")
+	providerName := fs.String("provider", "", fmt.Sprintf("Series provider, one of %v (default %s)", models.ProvidersList(), models.DEFAULT_PROVIDER))
+	serve        := fs.String("serve", "", "Run as a daemon exposing the HTTP API on the given address (e.g. :8080)")
+	seriesID     := fs.String("series-id", "", "Select the series with this id")
+	slug         := fs.String("slug", "", "Select the series with this slug")
+	pick         := fs.Uint("pick", 0, "Select the Nth series of the results")
+	episodesSpec := fs.String("episodes", "", "Episodes to download, e.g. 3-7,10, all or missing")
+	yes          := fs.Bool("yes", false, "Never ask: continue from the history and fail when a choice is ambiguous")
+	jsonMode     := fs.Bool("json", false, "Print the result as JSON, implies no prompts")
+	quality      := addQualityFlag(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := applyQuality(*quality); err != nil {
+		return err
+	}
+
+	if *jsonMode {
+		enableJSON()
+	}
+
+	interactive := !*yes && !*jsonMode
+	filter      := seriesFilter{
+		ID:          *seriesID,
+		Slug:        *slug,
+		Pick:        *pick,
+		Interactive: interactive,
+	}
+
+	var selection episodeSelection
+	if *episodesSpec != "" {
+		var err error
+		if selection, err = parseEpisodeSelection(*episodesSpec); err != nil {
+			exitWithError("⚠️ %s\n", err)
+		}
+	}
+
+	user, err := user.GetInstance(*userName)
+
+	if err != nil {
+		fmt.Printf("⚠️ %s\n", err)
+		os.Exit(EXIT_ERROR)
+	}
+
+	if *serve != "" {
+		return server.Start(appContext(), *serve, *userName)
+	}
+
+	filter.History = make(map[string]bool)
+	for _, h := range user.GetHistory() {
+		filter.History[h.SeriesID] = true
+	}
+
+	var selectedSeries models.Series
+	fromHistory := *list || (*series_title == "" && filter.isSet())
+
+	if fromHistory {
+		watchingSeries := user.GetHistory()
+
+		if len(watchingSeries) == 0 {
+			fmt.Println("You are not watching any series")
+			os.Exit(EXIT_ERROR)
+		}
+
+		historySeries := make([]models.Series, 0, len(watchingSeries))
+		for _, h := range watchingSeries {
+			historySeries = append(historySeries, models.Series{
+				ID       : h.SeriesID,
+				Name     : h.SeriesName,
+				Slug     : h.SeriesSlug,
+				Episodes : uint(h.SeriesTotEpisodes),
+			})
+		}
+
+		var err error
+		selectedSeries, err = selectSeries(historySeries, filter, func(i int, _ models.Series) string {
+			h := watchingSeries[i]
+			return fmt.Sprintf("%d) %s - %s: next %d", i+1, h.SeriesName, h.SeriesSlug, h.NextUnwatched())
+		})
+
+		if err != nil {
+			exitWithError("⚠️ %s\n", err)
+		}
+
+		for _, h := range watchingSeries {
+			if h.SeriesID == selectedSeries.ID && *providerName == "" {
+				*providerName = h.Provider
+				break
+			}
+		}
+	}
+
+	provider, err := models.GetProvider(*providerName)
+	if provider == nil {
+		fmt.Printf("⚠️ %s\n", err)
+		os.Exit(EXIT_ERROR)
+	}
+
+	if err != nil {
+		fmt.Printf("⚠️ %s\n", err)
+	}
+
+	if !fromHistory {
+		var err error
+
+		if selectedSeries, err = searchForSeries(provider, *series_title, filter); err != nil {
+			exitWithError("⚠️ Error retriving series \n\t- %s\n", err)
+		}
+	}
+
+	var selectedEpisode models.Episode
+	toContinue    := false
+	nextUnwatched := uint16(1)
+	isWatched     := func(number uint16) bool { return false }
+
+	for _, v := range user.GetHistory() {
+		if v.SeriesID != selectedSeries.ID || (v.Provider != provider.Name() && v.Provider != "") {
+			continue
+		}
+
+		nextUnwatched = v.NextUnwatched()
+		isWatched     = v.IsWatched
+
+		if *episodesSpec != "" {
+			continue
+		}
+
+		fmt.Printf("Last watched episode: %d, next unwatched: %d\n", v.EpisodeNumber, nextUnwatched)
+
+		switch {
+		case *yes:
+			toContinue = true
+		case interactive:
+			fmt.Println("Do you want to whatch the next episode? (y/n)")
+			toContinue = readConfirm()
+		default:
+			exitWithError("⚠️ %s\n", fmt.Errorf("%w: %s is in the history, use --yes to continue or --episodes", errAmbiguous, selectedSeries.Slug))
+		}
+
+		if toContinue {
+			selectedEpisode = models.Episode{
+				Number: nextUnwatched,
+			}
+		}
+	}
+
+	nextNEpisodes := nextEpisodesSetting()
+
+	var episodes []models.Episode
+	var toDownload []models.Episode
+
+	// a selection of more episodes is only downloaded, without playing one or the next ones
+	batch  := false
+	onDisk := episodesOnDisk(user.RootDir, provider.Name(), selectedSeries)
+
+	switch {
+	case *episodesSpec != "":
+		var err error
+		start, end  := selection.bounds()
+		episodes, err = provider.GetEpisodes(appContext(), selectedSeries, start, end)
+		if err != nil {
+			exitWithError("⚠️ Error retriving episodes \n\t- %s\n", err)
+		}
+
+		if toDownload, err = selection.apply(episodes, false, onDisk); err != nil {
+			exitWithError("⚠️ %s\n", err)
+		}
+		batch = true
+
+	case toContinue:
+		fmt.Printf("Continue watching episode %d\n", selectedEpisode.Number)
+
+		// GET ONLY WHAT NEEDED N = SELECTED.NUMBER
+		var err error
+		episodes, err = provider.GetEpisodes(appContext(), selectedSeries, uint(selectedEpisode.Number), unwatchedEnd(selectedEpisode.Number, nextNEpisodes, isWatched))
+
+		if err != nil {
+			fmt.Printf("⚠️ Error retriving episodes \n\t- %s\n", err)
+			fmt.Println("Continue to watch locally")
+			episodes = localEpisodes(user.RootDir, provider.Name(), selectedSeries)
+		}
+
+		for _, episode := range episodes {
+			if episode.Number == selectedEpisode.Number {
+				selectedEpisode = episode
+				break
+			}
+		}
+
+		toDownload = []models.Episode{selectedEpisode}
+
+	case interactive:
+		var err error
+		episodes, err = provider.GetEpisodes(appContext(), selectedSeries, 1, math.MaxUint)
+		if err != nil {
+			fmt.Printf("⚠️ Error retriving episodes, showing the downloaded ones \n\t- %s\n", err)
+			episodes = localEpisodes(user.RootDir, provider.Name(), selectedSeries)
+		}
+
+		if len(episodes) == 0 {
+			fmt.Println("No episodes found")
+			os.Exit(EXIT_ERROR)
+		}
+
+		var single bool
+		if toDownload, single, err = pickEpisodes(episodes, onDisk); err != nil {
+			exitWithError("⚠️ %s\n", err)
+		}
+
+		if single {
+			selectedEpisode = toDownload[0]
+		} else {
+			batch = true
+		}
+
+	default:
+		exitWithError("⚠️ %s\n", fmt.Errorf("%w: no episode selected, use --episodes", errAmbiguous))
+	}
+
+	if batch {
+		if *delete_prev && len(toDownload) > 0 {
+			deleteEpisodesBefore(user.RootDir, provider.Name(), selectedSeries, min(nextUnwatched, toDownload[0].Number))
+		}
+
+		results := downloadSelection(provider, selectedSeries, toDownload, user.RootDir)
+
+		if *jsonMode {
+			printJSON(jsonOutput{Provider: provider.Name(), Series: selectedSeries, Episodes: results})
+		} else {
+			printSummary(results)
+		}
+
+		return failedResults(results)
+	}
+
+	endEpisode := unwatchedEnd(selectedEpisode.Number, nextNEpisodes, isWatched)
+	fmt.Printf("End episode: %d\n", endEpisode)
+
+	var resultsMu sync.Mutex
+	results := []downloadResult{}
+	bars := progressbar.Start()
+	download := func(episode models.Episode) (string, error) {
+		fmt.Printf("⬇️ Downloading episode %d\n", episode.Number)
+		lib        := library.GetInstance(user.RootDir)
+		_, existed := lib.Find(provider.Name(), selectedSeries.ID, episode.Number)
+
+		path, error := provider.DownloadEpisode(appContext(), selectedSeries, episode, user.RootDir, bars.Update)
+		bars.Done(selectedSeries.Slug, episode.Number)
+
+		result := downloadResult{Episode: episode.Number, Status: STATUS_DOWNLOADED, Path: path}
+		if existed {
+			result.Status = STATUS_SKIPPED
+		}
+
+		if error != nil {
+			fmt.Printf("⚠️ Error downloading episode %d: \n\t- %s\n", episode.Number, error)
+			result.Status = STATUS_FAILED
+			result.Error  = error.Error()
+			if appContext().Err() == nil {
+				hooks.Failed(provider.Name(), selectedSeries, episode, error)
+			}
+		} else {
+			fmt.Printf("✅ Episode downloaded: %d\n", episode.Number)
+			result.Quality, _ = models.RecordedQuality(user.RootDir, selectedSeries, episode)
+			if !existed {
+				hooks.Downloaded(provider.Name(), selectedSeries, episode, path, result.Quality)
+			}
+		}
+
+		resultsMu.Lock()
+		results = append(results, result)
+		resultsMu.Unlock()
+
+		return path, error
+	}
+
+	// the next unwatched episode, when it's on disk and complete, to play it after the selected one
+	nextDownloaded := func(after uint16) (models.Episode, string, bool) {
+		onDisk := episodesOnDisk(user.RootDir, provider.Name(), selectedSeries)
+		for _, episode := range episodes {
+			if episode.Number <= after || isWatched(episode.Number) {
+				continue
+			}
+
+			path, ok := onDisk(episode)
+			if !ok || videocheck.Verify(path) != nil {
+				break
+			}
+			return episode, path, true
+		}
+
+		return models.Episode{}, "", false
+	}
+
+	pool := routinepoll.GetInstance()
+
+	for _, episode := range toDownload {
+		ep := episode
+		pool.AddTask(func() {
+			path, error := download(ep)
+			if error != nil || !interactive {
+				return
+			}
+
+			// never play, and mark as watched, a truncated file or an error page
+			if err := videocheck.Verify(path); err != nil {
+				fmt.Printf("⚠️ Episode %s is damaged, run verify --requeue to download it again: \n\t- %s\n", path, err)
+				return
+			}
+
+			for playing := ep; ; {
+				playback, err := player.Play(appContext(), path)
+				if err != nil {
+					fmt.Printf("⚠️ Error opening file to Play episode %s: \n\t- %s\n", path, err)
+					return
+				}
+
+				if !playback.Watched {
+					fmt.Printf("⏸️ Episode %d stopped at %s of %s, not marked as watched\n", playing.Number, seconds(playback.Position), seconds(playback.Duration))
+					return
+				}
+				user.AddHistory(provider.Name(), selectedSeries, playing)
+
+				if !playback.Ended {
+					return
+				}
+
+				next, nextPath, ok := nextDownloaded(playing.Number)
+				if !ok {
+					return
+				}
+
+				fmt.Printf("▶️ Episode %d is downloaded, do you want to play it? (y/n)\n", next.Number)
+				if !readConfirm() {
+					return
+				}
+				playing, path = next, nextPath
+			}
+		})
+	}
+
+	fmt.Printf("⬇️ Downloading next %d episodes\n", nextNEpisodes)
+
+	// the next episodes go through the saved queue, a killed run resumes them on the next start
+	q, err   := openQueue(user.RootDir, bars)
+	nextJobs := []uint64{}
+	if err != nil {
+		fmt.Printf("⚠️ Error downloading the next episodes: \n\t- %s\n", err)
+		nextNEpisodes = 0
+	}
+
+	// episodes is matched by number, not by position: the ones after the selected
+	// episode up to endEpisode are queued, skipping the watched ones
+	for _, episode := range episodes {
+
+		if episode.Number == selectedEpisode.Number || episode.Number < selectedEpisode.Number {
+			continue
+		}
+
+		if uint(episode.Number) > endEpisode || nextNEpisodes == 0 {
+			break
+		}
+
+		// going back to an episode doesn't download again the ones already watched
+		if isWatched(episode.Number) {
+			continue
+		}
+
+		nextJobs = append(nextJobs, q.Enqueue(provider.Name(), selectedSeries, episode).ID)
+		nextNEpisodes--
+	}
+
+	// only the episodes before the next unwatched one, and never the one being watched
+	if *delete_prev {
+		deleteEpisodesBefore(user.RootDir, provider.Name(), selectedSeries, min(nextUnwatched, selectedEpisode.Number))
+	}
+
+	pool.WaitAll()
+	bars.Stop()
+
+	results = append(results, jobResults(q, nextJobs, user.RootDir)...)
+
+	failed := false
+	for _, result := range results {
+		failed = failed || result.Error != ""
+	}
+
+	if *jsonMode {
+		printJSON(jsonOutput{
+			Provider: provider.Name(),
+			Series:   selectedSeries,
+			Episodes: results,
+		})
+	}
+
+	if appContext().Err() != nil {
+		exitInterrupted()
+	}
+
+	if failed && !interactive {
+		hooks.Wait()
+		os.Exit(EXIT_ERROR)
+	}
+	return nil
+}
+
+/*
+	Formats a position of the player like 21m4s
+*/
+func seconds(position float64) string {
+	return (time.Duration(position) * time.Second).String()
+}